@@ -4,18 +4,21 @@ go 1.18
 
 replace github.com/iacuity/datastore-connector v1.0.0 => ../datastore-connector
 
-require github.com/aerospike/aerospike-client-go/v5 v5.8.0
+require (
+	github.com/aerospike/aerospike-client-go/v5 v5.8.0
+	github.com/andybalholm/brotli v1.0.4
+	github.com/google/uuid v1.3.0
+	golang.org/x/sync v0.1.0
+)
 
 require (
 	github.com/ClickHouse/ch-go v0.49.0 // indirect
 	github.com/ClickHouse/clickhouse-go/v2 v2.4.1 // indirect
 	github.com/DATA-DOG/go-sqlmock v1.5.0 // indirect
 	github.com/aerospike/aerospike-client-go/v6 v6.10.0 // indirect
-	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/go-faster/city v1.0.1 // indirect
 	github.com/go-faster/errors v0.6.1 // indirect
 	github.com/go-sql-driver/mysql v1.6.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/ip2location/ip2location-go/v9 v9.4.1 // indirect
 	github.com/klauspost/compress v1.15.12 // indirect
 	github.com/kr/fs v0.1.0 // indirect
@@ -33,7 +36,6 @@ require (
 	go.uber.org/multierr v1.8.0 // indirect
 	go.uber.org/zap v1.23.0 // indirect
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect
-	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -0,0 +1,229 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval    = 5 * time.Second
+	defaultHealthCheckTimeout     = 1 * time.Second
+	defaultMaxConsecutiveFailures = 5
+	defaultEjectionCooldown       = 30 * time.Second
+)
+
+// BalancingStrategy is the strategy used to spread relative requests over
+// the configured endpoints
+type BalancingStrategy int
+
+const (
+	RoundRobinBalancing BalancingStrategy = iota
+	// smooth weighted round-robin using Endpoint.Weight
+	WeightedBalancing
+)
+
+// Endpoint is one of several equivalent base URLs of an upstream
+type Endpoint struct {
+	BaseURL string // e.g. https://api1.partner.com/v2
+	Weight  uint   // only used by WeightedBalancing, 0 means 1
+}
+
+type endpointState struct {
+	baseURL *url.URL
+	weight  int
+	current int // smooth weighted round-robin state, guarded by balancer.mu
+
+	consecutiveFailures int64
+	ejectedUntil        int64 // unix nano
+}
+
+func (ep *endpointState) available(now int64) bool {
+	return atomic.LoadInt64(&ep.ejectedUntil) <= now
+}
+
+// balancer routes relative requests over the endpoints and ejects the ones
+// failing consecutively until the cooldown has elapsed
+type balancer struct {
+	mu          sync.Mutex
+	endpoints   []*endpointState
+	next        uint64
+	strategy    BalancingStrategy
+	maxFailures int64
+	cooldown    time.Duration
+	stop        chan struct{}
+}
+
+func newBalancer(cfg ClientConfig) (*balancer, error) {
+	b := &balancer{
+		strategy:    cfg.EndpointBalancing,
+		maxFailures: (int64)(cfg.MaxConsecutiveFailures),
+		cooldown:    (time.Duration)(cfg.EjectionCooldownSec) * time.Second,
+		stop:        make(chan struct{}),
+	}
+	if 0 == b.maxFailures {
+		b.maxFailures = defaultMaxConsecutiveFailures
+	}
+	if 0 == b.cooldown {
+		b.cooldown = defaultEjectionCooldown
+	}
+
+	for _, endpoint := range cfg.Endpoints {
+		baseURL, err := url.Parse(endpoint.BaseURL)
+		if nil != err {
+			return nil, err
+		}
+
+		weight := (int)(endpoint.Weight)
+		if 0 == weight {
+			weight = 1
+		}
+		b.endpoints = append(b.endpoints, &endpointState{baseURL: baseURL, weight: weight})
+	}
+
+	return b, nil
+}
+
+// return the endpoint to use for the next request, when every endpoint is
+// ejected all of them are considered so requests keep flowing
+func (b *balancer) pick() *endpointState {
+	now := time.Now().UnixNano()
+	candidates := make([]*endpointState, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		if ep.available(now) {
+			candidates = append(candidates, ep)
+		}
+	}
+	if 0 == len(candidates) {
+		candidates = b.endpoints
+	}
+
+	if WeightedBalancing != b.strategy {
+		index := atomic.AddUint64(&b.next, 1) - 1
+		return candidates[index%(uint64)(len(candidates))]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *endpointState
+	total := 0
+	for _, ep := range candidates {
+		ep.current += ep.weight
+		total += ep.weight
+		if nil == best || ep.current > best.current {
+			best = ep
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func (b *balancer) recordSuccess(ep *endpointState) {
+	atomic.StoreInt64(&ep.consecutiveFailures, 0)
+}
+
+func (b *balancer) recordFailure(ep *endpointState) {
+	if atomic.AddInt64(&ep.consecutiveFailures, 1) >= b.maxFailures {
+		atomic.StoreInt64(&ep.ejectedUntil, time.Now().Add(b.cooldown).UnixNano())
+	}
+}
+
+// return the absolute URL of a relative request URL for the given endpoint
+func (ep *endpointState) resolve(relative *url.URL) *url.URL {
+	resolved := *ep.baseURL
+	resolved.Path = strings.TrimSuffix(ep.baseURL.Path, "/") + "/" + strings.TrimPrefix(relative.Path, "/")
+	resolved.RawPath = ""
+	resolved.RawQuery = relative.RawQuery
+	resolved.Fragment = ""
+	return &resolved
+}
+
+// probe every endpoint on the given interval until stopped
+func (b *balancer) runHealthChecks(client *http.Client, path string, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, ep := range b.endpoints {
+			wg.Add(1)
+			go func(ep *endpointState) {
+				defer wg.Done()
+				err := b.probe(client, ep, path, timeout)
+				if nil == err {
+					b.recordSuccess(ep)
+				} else if !errors.Is(err, ErrRateLimited) && !errors.Is(err, ErrCircuitOpen) {
+					// probes rejected locally say nothing about the endpoint
+					b.recordFailure(ep)
+				}
+			}(ep)
+		}
+		wg.Wait()
+	}
+}
+
+// return nil if the endpoint answers the probe with a 2xx status
+func (b *balancer) probe(client *http.Client, ep *endpointState, path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.resolve(&url.URL{Path: path}).String(), nil)
+	if nil != err {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if nil != err {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%w: %d", ErrUnexpectedStatus, response.StatusCode)
+	}
+	return nil
+}
+
+// balancerTransport sends relative requests to one of the endpoints,
+// requests with an absolute URL are passed through untouched
+type balancerTransport struct {
+	next     http.RoundTripper
+	balancer *balancer
+}
+
+func (t *balancerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if "" != r.URL.Host {
+		return t.next.RoundTrip(r)
+	}
+
+	ep := t.balancer.pick()
+	routed := r.WithContext(r.Context())
+	routed.URL = ep.resolve(r.URL)
+	routed.Host = ""
+
+	response, err := t.next.RoundTrip(routed)
+	if nil != err || response.StatusCode >= http.StatusInternalServerError {
+		// requests cancelled by the caller or rejected locally say nothing
+		// about the endpoint
+		if nil == r.Context().Err() && !errors.Is(err, ErrRateLimited) {
+			t.balancer.recordFailure(ep)
+		}
+	} else {
+		t.balancer.recordSuccess(ep)
+	}
+
+	return response, err
+}
@@ -0,0 +1,228 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitOpenTimeout  = 10 * time.Second
+	defaultHalfOpenMaxRequests = 1
+)
+
+var (
+	ErrCircuitOpen = errors.New("Circuit Open")
+)
+
+// CircuitState is the state of the circuit breaker of a destination host
+type CircuitState int
+
+const (
+	// requests flow normally
+	CircuitClosed CircuitState = iota
+	// requests are short-circuited with ErrCircuitOpen
+	CircuitOpen
+	// a limited number of probe requests decide whether to close again
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type CircuitBreakerConfig struct {
+	// consecutive failures (errors or 5xx) opening the circuit of a host,
+	// 0 disables circuit breaking
+	FailureThreshold uint
+	// time spent open before letting probe requests through, 0 means 10 seconds
+	OpenTimeoutMS uint
+	// probe requests allowed at a time while half-open, 0 means 1
+	HalfOpenMaxRequests uint
+	// invoked (synchronously) on every state change
+	OnStateChange func(host string, from, to CircuitState)
+}
+
+type circuitBreaker struct {
+	mu               sync.Mutex
+	state            CircuitState
+	failures         uint
+	openedAt         time.Time
+	halfOpenInflight uint
+}
+
+// circuitBreakers holds one breaker per destination host
+type circuitBreakers struct {
+	cfg         CircuitBreakerConfig
+	openTimeout time.Duration
+	maxProbes   uint
+	breakers    sync.Map // host -> *circuitBreaker
+}
+
+func newCircuitBreakers(cfg CircuitBreakerConfig) *circuitBreakers {
+	if 0 == cfg.FailureThreshold {
+		return nil
+	}
+
+	cbs := &circuitBreakers{
+		cfg:         cfg,
+		openTimeout: (time.Duration)(cfg.OpenTimeoutMS) * time.Millisecond,
+		maxProbes:   cfg.HalfOpenMaxRequests,
+	}
+	if 0 == cbs.openTimeout {
+		cbs.openTimeout = defaultCircuitOpenTimeout
+	}
+	if 0 == cbs.maxProbes {
+		cbs.maxProbes = defaultHalfOpenMaxRequests
+	}
+
+	return cbs
+}
+
+func (cbs *circuitBreakers) breaker(host string) *circuitBreaker {
+	if cb, ok := cbs.breakers.Load(host); ok {
+		return cb.(*circuitBreaker)
+	}
+
+	cb, _ := cbs.breakers.LoadOrStore(host, &circuitBreaker{})
+	return cb.(*circuitBreaker)
+}
+
+func (cbs *circuitBreakers) state(host string) CircuitState {
+	cb := cbs.breaker(host)
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// return true if a request to host may be sent
+func (cbs *circuitBreakers) allow(host string) bool {
+	cb := cbs.breaker(host)
+	cb.mu.Lock()
+
+	from := cb.state
+	allowed := true
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cbs.openTimeout {
+			allowed = false
+			break
+		}
+		cb.state = CircuitHalfOpen
+		cb.halfOpenInflight = 1
+
+	case CircuitHalfOpen:
+		if cb.halfOpenInflight >= cbs.maxProbes {
+			allowed = false
+			break
+		}
+		cb.halfOpenInflight++
+	}
+
+	to := cb.state
+	cb.mu.Unlock()
+
+	cbs.notify(host, from, to)
+	return allowed
+}
+
+// record the outcome of a request allowed by allow
+func (cbs *circuitBreakers) record(host string, success bool) {
+	cb := cbs.breaker(host)
+	cb.mu.Lock()
+
+	from := cb.state
+	switch cb.state {
+	case CircuitClosed:
+		if success {
+			cb.failures = 0
+		} else if cb.failures++; cb.failures >= cbs.cfg.FailureThreshold {
+			cb.state = CircuitOpen
+			cb.openedAt = time.Now()
+		}
+
+	case CircuitHalfOpen:
+		cb.halfOpenInflight--
+		if success {
+			cb.state = CircuitClosed
+			cb.failures = 0
+		} else {
+			cb.state = CircuitOpen
+			cb.openedAt = time.Now()
+		}
+	}
+
+	to := cb.state
+	cb.mu.Unlock()
+
+	cbs.notify(host, from, to)
+}
+
+func (cbs *circuitBreakers) notify(host string, from, to CircuitState) {
+	if from != to && nil != cbs.cfg.OnStateChange {
+		cbs.cfg.OnStateChange(host, from, to)
+	}
+}
+
+// return the circuit state of the given destination host ("host:port")
+func (client *HTTPClient) CircuitState(host string) CircuitState {
+	if nil == client.breakers {
+		return CircuitClosed
+	}
+	return client.breakers.state(host)
+}
+
+// return true if the request was short-circuited by an open circuit breaker
+func (req *HTTPRequest) IsCircuitOpen() bool {
+	return req.circuitOpen
+}
+
+// breakerTransport short-circuits requests to hosts whose circuit is open
+type breakerTransport struct {
+	next     http.RoundTripper
+	breakers *circuitBreakers
+}
+
+func (t *breakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Host
+	if !t.breakers.allow(host) {
+		if nil != r.Body {
+			r.Body.Close()
+		}
+		return nil, ErrCircuitOpen
+	}
+
+	response, err := t.next.RoundTrip(r)
+	ctxErr := r.Context().Err()
+	if executeErr := executeContextErr(r.Context()); nil != executeErr {
+		ctxErr = executeErr
+	}
+	if (nil != err && errors.Is(ctxErr, context.Canceled)) || errors.Is(err, ErrRateLimited) {
+		// the caller gave up or the request was never sent, so it says
+		// nothing about the host but it may have been a half-open probe.
+		// timeouts are failures, a host too slow to answer is not healthy
+		t.breakers.release(host)
+	} else {
+		t.breakers.record(host, nil == err && response.StatusCode < http.StatusInternalServerError)
+	}
+
+	return response, err
+}
+
+// release a request allowed by allow without recording an outcome
+func (cbs *circuitBreakers) release(host string) {
+	cb := cbs.breaker(host)
+	cb.mu.Lock()
+	if CircuitHalfOpen == cb.state && cb.halfOpenInflight > 0 {
+		cb.halfOpenInflight--
+	}
+	cb.mu.Unlock()
+}
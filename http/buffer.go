@@ -0,0 +1,50 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// buffers grown beyond this size are dropped instead of being pooled so a
+	// few large responses do not pin memory
+	maxPooledBodyBufferSize = 1 << 20 // 1 MiB
+)
+
+var bodyBufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBodyBuffer() *bytes.Buffer {
+	buff := bodyBufferPool.Get().(*bytes.Buffer)
+	buff.Reset()
+	return buff
+}
+
+func putBodyBuffer(buff *bytes.Buffer) {
+	if buff.Cap() <= maxPooledBodyBufferSize {
+		bodyBufferPool.Put(buff)
+	}
+}
+
+// read reader into a pooled buffer, the caller owns the buffer
+func (req *HTTPRequest) readBody(reader io.Reader, sizeHint int64) (*bytes.Buffer, error) {
+	startTime := time.Now()
+	buff := getBodyBuffer()
+	if sizeHint > 0 && sizeHint <= maxPooledBodyBufferSize {
+		buff.Grow((int)(sizeHint))
+	}
+
+	_, err := buff.ReadFrom(reader)
+	req.timings.BodyRead = time.Since(startTime)
+	if nil != err {
+		putBodyBuffer(buff)
+		return nil, err
+	}
+
+	return buff, nil
+}
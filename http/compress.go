@@ -0,0 +1,104 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// gzip writers are expensive to create, keep one pool per compression level
+// (gzip.HuffmanOnly to gzip.BestCompression)
+var gzipWriterPools [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+func getGzipWriter(w io.Writer, level int) *gzip.Writer {
+	if gw, ok := gzipWriterPools[level-gzip.HuffmanOnly].Get().(*gzip.Writer); ok {
+		gw.Reset(w)
+		return gw
+	}
+
+	// level is validated by the callers
+	gw, _ := gzip.NewWriterLevel(w, level)
+	return gw
+}
+
+func putGzipWriter(gw *gzip.Writer, level int) {
+	gzipWriterPools[level-gzip.HuffmanOnly].Put(gw)
+}
+
+// return the gzip level to use, 0 means the default compression
+func compressionLevel(level int) int {
+	if 0 == level || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+// gzip the body of the given request in place and set its Content-Encoding
+func compressRequest(r *http.Request, level int) error {
+	if nil == r.Body || http.NoBody == r.Body {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if nil != err {
+		return err
+	}
+
+	level = compressionLevel(level)
+	var buff bytes.Buffer
+	gw := getGzipWriter(&buff, level)
+	_, err = gw.Write(data)
+	if nil == err {
+		err = gw.Close()
+	}
+	putGzipWriter(gw, level)
+	if nil != err {
+		return err
+	}
+
+	compressed := buff.Bytes()
+	r.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	r.ContentLength = int64(len(compressed))
+	r.Header.Set("Content-Encoding", "gzip")
+
+	return nil
+}
+
+// gzip the request body with the given level, 0 means the default level
+func (req *HTTPRequest) CompressBody(level int) error {
+	return compressRequest(req.request, level)
+}
+
+// compressionTransport gzips request bodies of at least minBytes that do not
+// already carry a Content-Encoding
+type compressionTransport struct {
+	next     http.RoundTripper
+	level    int
+	minBytes int64
+}
+
+func (t *compressionTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// multipart bodies are streamed from disk, compressing them would buffer
+	// the whole upload in memory
+	if nil == r.Body || http.NoBody == r.Body || r.ContentLength < t.minBytes ||
+		"" != r.Header.Get("Content-Encoding") ||
+		strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return t.next.RoundTrip(r)
+	}
+
+	// a RoundTripper must not modify the caller's request
+	compressed := r.Clone(r.Context())
+	if err := compressRequest(compressed, t.level); nil != err {
+		return nil, err
+	}
+
+	return t.next.RoundTrip(compressed)
+}
@@ -0,0 +1,180 @@
+package http
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// dnsEntry holds the addresses resolved for a host
+type dnsEntry struct {
+	addrs    []string
+	expiry   time.Time
+	next     uint32 // rotation index over addrs
+	lastUsed int64  // unix nano
+}
+
+// dnsCache is an in-process DNS cache used by the pooled transports dialers.
+// hosts are re-resolved in the background before their TTL expires and the
+// last resolved addresses keep being served when the resolver fails
+type dnsCache struct {
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	ttl        time.Duration
+	group      singleflight.Group
+	mu         sync.RWMutex
+	entries    map[string]*dnsEntry
+	stop       chan struct{}
+}
+
+func newDNSCache(ttl, refreshInterval time.Duration) *dnsCache {
+	cache := &dnsCache{
+		lookupHost: net.DefaultResolver.LookupHost,
+		ttl:        ttl,
+		entries:    make(map[string]*dnsEntry),
+		stop:       make(chan struct{}),
+	}
+
+	if 0 == refreshInterval {
+		refreshInterval = ttl / 2
+	}
+	go cache.refreshLoop(refreshInterval)
+
+	return cache
+}
+
+// return the addresses of host. expired addresses are returned as is while
+// the host is re-resolved in the background, the lookup only blocks on the
+// resolver when the host is not cached
+func (cache *dnsCache) lookup(ctx context.Context, host string) (*dnsEntry, error) {
+	cache.mu.RLock()
+	entry := cache.entries[host]
+	cache.mu.RUnlock()
+
+	if nil == entry {
+		return cache.resolve(ctx, host)
+	}
+
+	if !time.Now().Before(entry.expiry) {
+		// failures keep the stale addresses, they are better than no
+		// address at all
+		cache.resolveAsync(host)
+	}
+	atomic.StoreInt64(&entry.lastUsed, time.Now().UnixNano())
+	return entry, nil
+}
+
+// resolve host and cache the result, concurrent lookups of the same host
+// share a single resolver call
+func (cache *dnsCache) resolve(ctx context.Context, host string) (*dnsEntry, error) {
+	select {
+	case res := <-cache.resolveAsync(host):
+		if nil != res.Err {
+			return nil, res.Err
+		}
+		return res.Val.(*dnsEntry), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// start resolving host unless it is already being resolved, the result is
+// delivered on the returned channel
+func (cache *dnsCache) resolveAsync(host string) <-chan singleflight.Result {
+	return cache.group.DoChan(host, func() (any, error) {
+		// detached from the caller as the result is shared
+		lookupCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		addrs, err := cache.lookupHost(lookupCtx, host)
+		if nil != err {
+			return nil, err
+		}
+		if 0 == len(addrs) {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+
+		entry := &dnsEntry{
+			addrs:    addrs,
+			expiry:   time.Now().Add(cache.ttl),
+			lastUsed: time.Now().UnixNano(),
+		}
+
+		cache.mu.Lock()
+		if previous, ok := cache.entries[host]; ok {
+			entry.next = atomic.LoadUint32(&previous.next)
+			entry.lastUsed = atomic.LoadInt64(&previous.lastUsed)
+		}
+		cache.entries[host] = entry
+		cache.mu.Unlock()
+
+		return entry, nil
+	})
+}
+
+// re-resolve the cached hosts on every interval, hosts unused for several
+// TTLs are evicted instead
+func (cache *dnsCache) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cache.stop:
+			return
+		case <-ticker.C:
+		}
+
+		evictBefore := time.Now().Add(-4 * cache.ttl).UnixNano()
+		hosts := make([]string, 0)
+		cache.mu.Lock()
+		for host, entry := range cache.entries {
+			if atomic.LoadInt64(&entry.lastUsed) < evictBefore {
+				delete(cache.entries, host)
+				continue
+			}
+			hosts = append(hosts, host)
+		}
+		cache.mu.Unlock()
+
+		for _, host := range hosts {
+			// failures keep the previous addresses
+			cache.resolve(context.Background(), host)
+		}
+	}
+}
+
+// return a DialContext dialing the cached addresses of the host in turn,
+// starting from a different address on every call
+func (cache *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if nil != err {
+			return nil, err
+		}
+		if nil != net.ParseIP(host) {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		entry, err := cache.lookup(ctx, host)
+		if nil != err {
+			return nil, err
+		}
+
+		count := uint32(len(entry.addrs))
+		start := atomic.AddUint32(&entry.next, 1) - 1
+		var conn net.Conn
+		for idx := uint32(0); idx < count; idx++ {
+			addr := entry.addrs[(start+idx)%count]
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if nil == err || nil != ctx.Err() {
+				break
+			}
+		}
+
+		return conn, err
+	}
+}
@@ -4,11 +4,9 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"io/ioutil"
-	"net"
 	"net/http"
+	"sort"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +18,13 @@ type HTTPClient struct {
 	clients     []*http.Client
 	clientIndex uint64
 	clientCount uint64
+	metrics     *Metrics
+	selection   ClientSelection
+	inflight    []int64
+	balancer    *balancer
+	breakers    *circuitBreakers
+	dnsCache    *dnsCache
+	closeOnce   sync.Once
 }
 
 type ClientConfig struct {
@@ -30,41 +35,174 @@ type ClientConfig struct {
 	ConnectionTimeoutMS uint
 	KeepAliveSec        uint
 	MaxHTTPClient       uint
+	// gzip request bodies of at least this many bytes, 0 disables compression
+	RequestCompressionMinBytes uint
+	// gzip level used for request bodies, 0 means gzip.DefaultCompression
+	RequestCompressionLevel int
+	// applied in order to every request sent by the pooled http.Clients,
+	// the first interceptor sees the request first
+	Interceptors []Interceptor
+	// 0 means 10 seconds
+	TLSHandshakeTimeoutMS uint
+	// PEM bundle of CAs trusted in addition to the system ones
+	CACertFile string
+	// PEM client certificate and key used for mTLS
+	ClientCertFile string
+	ClientKeyFile  string
+	// e.g. tls.VersionTLS12, 0 means the crypto/tls default
+	MinTLSVersion uint16
+	// skip server certificate verification, only meant for staging
+	InsecureSkipVerify bool
+	// HTTP(S) proxy used for all requests except the NoProxy hosts,
+	// NoProxy entries are "*", IPs, CIDR ranges or domains (matching subdomains)
+	ProxyURL string
+	NoProxy  []string
+	// HTTP/2 is not attempted by default, use ForceHTTP2 to enable it or
+	// DisableHTTP2 to never negotiate it
+	ForceHTTP2   bool
+	DisableHTTP2 bool
+	// strategy used to pick a pooled http.Client, round-robin by default
+	ClientSelection ClientSelection
+	// equivalent base URLs the relative request URLs (e.g. "/v1/bid") are
+	// routed to, absolute request URLs are not affected
+	Endpoints         []Endpoint
+	EndpointBalancing BalancingStrategy
+	// path probed with a GET on every endpoint, empty disables health checks
+	HealthCheckPath       string
+	HealthCheckIntervalMS uint // 0 means 5 seconds
+	HealthCheckTimeoutMS  uint // 0 means 1 second
+	// an endpoint failing this many times in a row (errors or 5xx) is ejected
+	// for EjectionCooldownSec, 0 means 5 failures and 30 seconds
+	MaxConsecutiveFailures uint
+	EjectionCooldownSec    uint
+	// token bucket limits keyed by request host ("host" or "host:port"),
+	// applied along with the global limit, a zero QPS means no limit
+	HostRateLimits  map[string]RateLimit
+	GlobalRateLimit RateLimit
+	RateLimitMode   RateLimitMode
+	// per destination host circuit breakers, disabled by default
+	CircuitBreaker CircuitBreakerConfig
+	// cache resolved host addresses in process for this long, rotating over
+	// them when dialing, 0 disables the cache
+	DNSCacheTTLSec uint
+	// background re-resolution interval of cached hosts, 0 means half the TTL
+	DNSRefreshIntervalSec uint
 }
 
 func NewHTTPClient(cfg ClientConfig) (*HTTPClient, error) {
+	if cfg.ForceHTTP2 && cfg.DisableHTTP2 {
+		return nil, ErrConflictingHTTP2
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if nil != err {
+		return nil, err
+	}
+
+	proxy, err := newProxyFunc(cfg)
+	if nil != err {
+		return nil, err
+	}
+
+	var lb *balancer
+	if len(cfg.Endpoints) > 0 {
+		if lb, err = newBalancer(cfg); nil != err {
+			return nil, err
+		}
+	}
+
+	var dns *dnsCache
+	if cfg.DNSCacheTTLSec > 0 {
+		dns = newDNSCache(
+			(time.Duration)(cfg.DNSCacheTTLSec)*time.Second,
+			(time.Duration)(cfg.DNSRefreshIntervalSec)*time.Second)
+	}
+
+	metrics := &Metrics{}
+	limiter := newRateLimiter(cfg)
+	breakers := newCircuitBreakers(cfg.CircuitBreaker)
 	clients := make([]*http.Client, cfg.MaxHTTPClient)
 	var idx uint = 0
 	for ; idx < cfg.MaxHTTPClient; idx++ {
+		var transport http.RoundTripper = newTransport(cfg, tlsConfig, proxy, dns)
+		transport = &metricsTransport{next: transport, metrics: metrics}
+		if nil != limiter {
+			transport = &rateLimitTransport{next: transport, limiter: limiter, metrics: metrics}
+		}
+		if nil != breakers {
+			transport = &breakerTransport{next: transport, breakers: breakers}
+		}
+		if nil != lb {
+			transport = &balancerTransport{next: transport, balancer: lb}
+		}
+
+		if cfg.RequestCompressionMinBytes > 0 {
+			transport = &compressionTransport{
+				next:     transport,
+				level:    cfg.RequestCompressionLevel,
+				minBytes: (int64)(cfg.RequestCompressionMinBytes),
+			}
+		}
+		transport = chainInterceptors(transport, cfg.Interceptors)
+
 		clients[idx] = &http.Client{
-			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout:   (time.Duration)(cfg.ConnectionTimeoutMS) * time.Millisecond,
-					KeepAlive: (time.Duration)(cfg.KeepAliveSec) * time.Second,
-				}).Dial,
-				DisableKeepAlives:   false,
-				IdleConnTimeout:     time.Duration(cfg.IdleConnTimeoutSec) * time.Second,
-				MaxIdleConnsPerHost: (int)(cfg.MaxIdleConnsPerHost / (uint)(cfg.MaxHTTPClient)),
-				MaxConnsPerHost:     (int)(cfg.MaxConnsPerHost / (uint)(cfg.MaxHTTPClient)),
-				TLSHandshakeTimeout: 10 * time.Second,
-			},
-			Timeout: time.Duration(cfg.RequestTimeoutMS) * time.Millisecond,
+			Transport: transport,
+			Timeout:   time.Duration(cfg.RequestTimeoutMS) * time.Millisecond,
 		}
 	}
-	return &HTTPClient{
+	client := &HTTPClient{
 		clients:     clients,
 		clientCount: (uint64)(cfg.MaxHTTPClient),
 		clientIndex: 0,
-	}, nil
+		metrics:     metrics,
+		selection:   cfg.ClientSelection,
+		inflight:    make([]int64, cfg.MaxHTTPClient),
+		balancer:    lb,
+		breakers:    breakers,
+		dnsCache:    dns,
+	}
+
+	if nil != lb && "" != cfg.HealthCheckPath {
+		interval := (time.Duration)(cfg.HealthCheckIntervalMS) * time.Millisecond
+		if 0 == interval {
+			interval = defaultHealthCheckInterval
+		}
+		timeout := (time.Duration)(cfg.HealthCheckTimeoutMS) * time.Millisecond
+		if 0 == timeout {
+			timeout = defaultHealthCheckTimeout
+		}
+		go lb.runHealthChecks(clients[0], cfg.HealthCheckPath, interval, timeout)
+	}
+
+	return client, nil
 }
 
-func (client *HTTPClient) GetClient() *http.Client {
-	index := atomic.AddUint64(&client.clientIndex, 1)
-	if index > client.clientCount {
-		atomic.SwapUint64(&client.clientIndex, 0)
+// stop the background work of the client (health checks, DNS refresh)
+// and close its idle connections, it can be called more than once
+func (client *HTTPClient) Close() {
+	client.closeOnce.Do(func() {
+		if nil != client.balancer {
+			close(client.balancer.stop)
+		}
+		if nil != client.dnsCache {
+			close(client.dnsCache.stop)
+		}
+	})
+	for _, httpClient := range client.clients {
+		httpClient.CloseIdleConnections()
 	}
+}
 
-	return client.clients[index%client.clientCount]
+// return the per host metrics of all requests sent through this client
+func (client *HTTPClient) Metrics() *Metrics {
+	return client.metrics
+}
+
+// return one of the pooled clients according to the configured selection,
+// requests sent through it are not tracked as in flight, use AcquireClient
+// when the least loaded selections are configured
+func (client *HTTPClient) GetClient() *http.Client {
+	return client.clients[client.selectIndex()]
 }
 
 type HTTPRequest struct {
@@ -73,6 +211,16 @@ type HTTPRequest struct {
 	timedout   bool
 	err        error
 	respTimeMS int64
+	timeout    time.Duration
+	priority   int
+	cancel     context.CancelFunc
+	timings    RequestTimings
+	// set when the request was short-circuited by an open circuit breaker
+	circuitOpen bool
+	// pooled buffers holding the response body as received and decoded,
+	// they are the same buffer when the body is not encoded. released by Close
+	body        *bytes.Buffer
+	decodedBody *bytes.Buffer
 }
 
 // create and return the HTTPRequest object
@@ -102,23 +250,62 @@ func (req *HTTPRequest) AddHeader(key, value string) {
 	req.request.Header.Add(key, value)
 }
 
+// set the timeout of this request, it is applied in addition to the
+// deadline of the context passed to Execute so it can only make it tighter.
+// the timeout also covers reading the response body
+func (req *HTTPRequest) SetTimeout(timeout time.Duration) {
+	req.timeout = timeout
+}
+
+// set the dispatch priority of this request, higher priority requests are
+// dispatched first when MultiHTTPRequestContext runs with a concurrency limit
+func (req *HTTPRequest) SetPriority(priority int) {
+	req.priority = priority
+}
+
+// close the response and release the body buffer, the slices returned by
+// GetResponseBody and ReadResponseBody must not be used after Close
 func (req *HTTPRequest) Close() {
 	if nil != req.response {
 		req.response.Body.Close()
 	}
+	if nil != req.cancel {
+		req.cancel()
+	}
+	if nil != req.decodedBody && req.decodedBody != req.body {
+		putBodyBuffer(req.decodedBody)
+	}
+	if nil != req.body {
+		putBodyBuffer(req.body)
+	}
+	req.body, req.decodedBody = nil, nil
 }
 
+// return the response body as received, the returned slice is owned by the
+// request and only valid until Close is called, copy it to retain it longer.
+// ErrBodyDecoded is returned when ReadResponseBody already consumed an
+// encoded body
 func (req *HTTPRequest) GetResponseBody() ([]byte, error) {
 	if nil == req.response {
-		return nil, errors.New("http.Response is null")
+		return nil, ErrNilResponse
 	}
 
-	body, err := ioutil.ReadAll(req.response.Body)
-	if nil != err {
-		return nil, err
+	if nil == req.body {
+		if nil != req.decodedBody {
+			if !isIdentityEncoding(req.response.Header.Get("Content-Encoding")) {
+				return nil, ErrBodyDecoded
+			}
+			req.body = req.decodedBody
+		} else {
+			buff, err := req.readBody(req.response.Body, req.response.ContentLength)
+			if nil != err {
+				return nil, err
+			}
+			req.body = buff
+		}
 	}
 
-	return body, nil
+	return req.body.Bytes(), nil
 }
 
 func (req *HTTPRequest) IsTimedout() bool {
@@ -146,14 +333,15 @@ func (req *HTTPRequest) GetResponseTimeMS() int64 {
 }
 
 type MultiHTTPRequestContext struct {
-	client       *http.Client
-	httpRequests []*HTTPRequest
+	client         *HTTPClient
+	httpRequests   []*HTTPRequest
+	maxConcurrency int
 }
 
 func NewMultiHTTPRequestContext(client *HTTPClient) *MultiHTTPRequestContext {
 	return &MultiHTTPRequestContext{
 		httpRequests: make([]*HTTPRequest, 0),
-		client:       client.GetClient(),
+		client:       client,
 	}
 }
 
@@ -161,54 +349,226 @@ func (mCtx *MultiHTTPRequestContext) AddHTTPRequest(request *HTTPRequest) {
 	mCtx.httpRequests = append(mCtx.httpRequests, request)
 }
 
-func cleanResponse(respChan chan *http.Response) {
-	response := <-respChan
-	if nil != response {
-		response.Body.Close()
-	}
+// limit the number of requests in flight at a time, 0 means no limit.
+// when the limit is hit requests are dispatched in priority order
+func (mCtx *MultiHTTPRequestContext) SetMaxConcurrency(maxConcurrency int) {
+	mCtx.maxConcurrency = maxConcurrency
 }
 
 func (req *HTTPRequest) execute(
-	httpClient *http.Client,
-	wg *sync.WaitGroup,
+	client *HTTPClient,
 	startTime time.Time,
-	timeoutCtx context.Context) {
-	ctx, cancel := context.WithCancel(timeoutCtx)
-
-	defer func() {
+	watch *headersWatch) {
+	// the call is bound to the context of the request, to its timeout and,
+	// until the response headers are received, to the context passed to
+	// Execute. the derived contexts must outlive this function as the body
+	// is read afterwards, they are cancelled by Close
+	ctx := req.request.Context()
+	timeoutCancel := context.CancelFunc(func() {})
+	if req.timeout > 0 {
+		ctx, timeoutCancel = context.WithTimeout(ctx, req.timeout)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	req.cancel = func() {
 		cancel()
-		wg.Done()
-	}()
+		timeoutCancel()
+	}
+	if nil != watch {
+		if !watch.add(req, cancel) {
+			req.markTimedout(startTime)
+			return
+		}
+		ctx = context.WithValue(ctx, headersWatchKey{}, watch)
+	}
 
-	respChan := make(chan *http.Response)
-	var response *http.Response
-	var err error
-	go func() {
-		response, err = httpClient.Do(req.request)
-		respChan <- response
-	}()
+	tracer := newPhaseTracer()
+	request := req.request.WithContext(tracer.withContext(ctx))
 
-	select {
-	case response := <-respChan:
-		req.response = response
-		req.err = err
-		req.respTimeMS = time.Since(startTime).Milliseconds()
+	idx := client.acquire()
+	response, err := client.clients[idx].Do(request)
+	client.release(idx)
 
-	case <-ctx.Done():
+	// the requests cancelled by their own context are not timed out
+	expired := nil != watch && !watch.remove(req)
+	timedout := expired || (nil != err && errors.Is(ctx.Err(), context.DeadlineExceeded))
+
+	req.response = response
+	req.err = err
+	req.respTimeMS = time.Since(startTime).Milliseconds()
+	req.timings = tracer.result()
+	if nil == err && expired {
+		// the Execute context expired as the response arrived, its body
+		// cannot be read anymore
+		response.Body.Close()
+		req.response = nil
 		req.timedout = true
 		req.err = reqTimeoutError
-		go cleanResponse(respChan)
+	} else if timedout {
+		req.timedout = true
+		req.err = reqTimeoutError
+	} else if errors.Is(err, ErrCircuitOpen) {
+		req.circuitOpen = true
+		req.err = ErrCircuitOpen
 	}
 }
 
-// make call to all request present in MultiHTTPRequestContext
-func (mCtx *MultiHTTPRequestContext) Execute(ctx context.Context) {
+// headersWatch cancels the requests of an Execute call which are still
+// waiting for their response headers when its context is done, reading the
+// bodies afterwards is not bound to it. a single goroutine watches all the
+// requests of the call
+type headersWatch struct {
+	mu      sync.Mutex
+	err     error
+	pending map[*HTTPRequest]context.CancelFunc
+}
+
+type headersWatchKey struct{}
+
+// watch ctx until stop is closed
+func watchHeaders(ctx context.Context, stop <-chan struct{}) *headersWatch {
+	watch := &headersWatch{pending: make(map[*HTTPRequest]context.CancelFunc)}
+	go func() {
+		select {
+		case <-ctx.Done():
+			watch.expire(ctx.Err())
+		case <-stop:
+		}
+	}()
+	return watch
+}
+
+func (watch *headersWatch) expire(err error) {
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+
+	watch.err = err
+	for _, cancel := range watch.pending {
+		cancel()
+	}
+	watch.pending = nil
+}
+
+// register a request waiting for its headers, false if the context already
+// expired
+func (watch *headersWatch) add(req *HTTPRequest, cancel context.CancelFunc) bool {
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+
+	if nil != watch.err {
+		return false
+	}
+	watch.pending[req] = cancel
+	return true
+}
+
+// unregister a request once its round trip completed, false if it was
+// cancelled by the expiry of the context
+func (watch *headersWatch) remove(req *HTTPRequest) bool {
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+
+	if nil != watch.err {
+		return false
+	}
+	delete(watch.pending, req)
+	return true
+}
+
+// return the error of the Execute context when it cancelled the request of
+// ctx, nil otherwise. the transports use it to tell an expired Execute
+// context from a request cancelled by the caller
+func executeContextErr(ctx context.Context) error {
+	watch, ok := ctx.Value(headersWatchKey{}).(*headersWatch)
+	if !ok {
+		return nil
+	}
+
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	return watch.err
+}
+
+func (req *HTTPRequest) markTimedout(startTime time.Time) {
+	req.timedout = true
+	req.err = reqTimeoutError
+	req.respTimeMS = time.Since(startTime).Milliseconds()
+}
+
+// dispatch all requests and block until every one of them has completed,
+// onDone (if not nil) is invoked as soon as each request completes
+func (mCtx *MultiHTTPRequestContext) run(ctx context.Context, onDone func(*HTTPRequest)) {
 	var wg sync.WaitGroup
 	startTime := time.Now()
-	for _, req := range mCtx.httpRequests {
+
+	var watch *headersWatch
+	if nil != ctx.Done() {
+		stop := make(chan struct{})
+		defer close(stop)
+		watch = watchHeaders(ctx, stop)
+	}
+
+	requests := mCtx.httpRequests
+	var slots chan struct{}
+	if mCtx.maxConcurrency > 0 && mCtx.maxConcurrency < len(requests) {
+		slots = make(chan struct{}, mCtx.maxConcurrency)
+		requests = make([]*HTTPRequest, len(mCtx.httpRequests))
+		copy(requests, mCtx.httpRequests)
+		sort.SliceStable(requests, func(i, j int) bool {
+			return requests[i].priority > requests[j].priority
+		})
+	}
+
+	for _, req := range requests {
+		if nil != slots {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				// request never got dispatched before the deadline
+				req.markTimedout(startTime)
+				if nil != onDone {
+					onDone(req)
+				}
+				continue
+			}
+		}
+
 		wg.Add(1)
-		go req.execute(mCtx.client, &wg, startTime, ctx)
+		go func(req *HTTPRequest) {
+			defer wg.Done()
+			req.execute(mCtx.client, startTime, watch)
+			if nil != slots {
+				<-slots
+			}
+			if nil != onDone {
+				onDone(req)
+			}
+		}(req)
 	}
 
 	wg.Wait()
 }
+
+// make call to all request present in MultiHTTPRequestContext. the deadline
+// of ctx bounds the time to receive the response headers, reading the body
+// afterwards is only bound to the request timeout (see SetTimeout). a request
+// whose response arrives as ctx expires is reported as timed out
+func (mCtx *MultiHTTPRequestContext) Execute(ctx context.Context) {
+	mCtx.run(ctx, nil)
+}
+
+// make call to all request present in MultiHTTPRequestContext without waiting
+// for them to finish. each request is delivered on the returned channel as soon
+// as it completes (or times out), so callers can process fast responders while
+// slow ones are still in flight. the channel is closed once every request has
+// been delivered.
+func (mCtx *MultiHTTPRequestContext) ExecuteAsync(ctx context.Context) <-chan *HTTPRequest {
+	doneChan := make(chan *HTTPRequest, len(mCtx.httpRequests))
+	go func() {
+		mCtx.run(ctx, func(req *HTTPRequest) {
+			doneChan <- req
+		})
+		close(doneChan)
+	}()
+
+	return doneChan
+}
@@ -0,0 +1,1350 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) *HTTPClient {
+	client, err := NewHTTPClient(ClientConfig{
+		MaxIdleConnsPerHost: 10,
+		MaxConnsPerHost:     10,
+		IdleConnTimeoutSec:  10,
+		RequestTimeoutMS:    1000,
+		ConnectionTimeoutMS: 100,
+		KeepAliveSec:        10,
+		MaxHTTPClient:       2,
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func newDelayServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delay, err := time.ParseDuration(r.URL.Query().Get("delay")); nil == err {
+			time.Sleep(delay)
+		}
+		w.Write([]byte("ok"))
+	}))
+}
+
+func TestExecuteAsync(t *testing.T) {
+	server := newDelayServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	for _, delay := range []string{"200ms", "1ms", "1s"} {
+		req, err := NewHTTPRequest(ctx, server.URL+"?delay="+delay, nil)
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer req.Close()
+		mCtx.AddHTTPRequest(req)
+	}
+
+	var completed []*HTTPRequest
+	for req := range mCtx.ExecuteAsync(ctx) {
+		completed = append(completed, req)
+	}
+
+	if 3 != len(completed) {
+		t.Fatalf("Expected 3 completed requests, got %d", len(completed))
+	}
+	if completed[0] != mCtx.httpRequests[1] {
+		t.Error("Expected fastest request to be delivered first")
+	}
+	if !completed[2].IsTimedout() || reqTimeoutError != completed[2].Error() {
+		t.Error("Expected slowest request to time out")
+	}
+	if http.StatusOK != completed[0].ResponseStatusCode() {
+		t.Errorf("Unexpected status code %d", completed[0].ResponseStatusCode())
+	}
+}
+
+func TestExecuteWithConcurrencyLimit(t *testing.T) {
+	server := newDelayServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.SetMaxConcurrency(1)
+
+	low, _ := NewHTTPRequest(ctx, server.URL+"?delay=10ms", nil)
+	high, _ := NewHTTPRequest(ctx, server.URL+"?delay=10ms", nil)
+	high.SetPriority(10)
+	slow, _ := NewHTTPRequest(ctx, server.URL+"?delay=1s", nil)
+	slow.SetTimeout(50 * time.Millisecond)
+	slow.SetPriority(5)
+	for _, req := range []*HTTPRequest{low, high, slow} {
+		defer req.Close()
+		mCtx.AddHTTPRequest(req)
+	}
+
+	var order []*HTTPRequest
+	for req := range mCtx.ExecuteAsync(ctx) {
+		order = append(order, req)
+	}
+
+	if 3 != len(order) || high != order[0] || slow != order[1] || low != order[2] {
+		t.Fatal("Expected requests to complete in priority order")
+	}
+	if !slow.IsTimedout() {
+		t.Error("Expected per-request timeout to expire")
+	}
+	if low.IsTimedout() || http.StatusOK != low.ResponseStatusCode() {
+		t.Error("Expected low priority request to succeed after the slow one timed out")
+	}
+}
+
+type testPayload struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestDecodeJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(`{"name":"foo","count":3}`))
+		gw.Close()
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	req, _ := NewHTTPRequest(ctx, server.URL, nil)
+	// set explicitly so the transport does not decompress transparently
+	req.AddHeader("Accept-Encoding", "gzip")
+	defer req.Close()
+
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	if err := req.ExpectStatus(http.StatusOK); nil != err {
+		t.Fatal(err)
+	}
+	if err := req.ExpectStatus(http.StatusNoContent); !errors.Is(err, ErrUnexpectedStatus) {
+		t.Errorf("Expected ErrUnexpectedStatus, got %v", err)
+	}
+
+	payload, err := DecodeJSON[testPayload](req, 1024)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "foo" != payload.Name || 3 != payload.Count {
+		t.Errorf("Unexpected payload %+v", payload)
+	}
+}
+
+func TestExecuteDeadlineCoversHeadersOnly(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("late body"))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := NewHTTPRequest(context.Background(), server.URL, nil)
+	defer req.Close()
+
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	if req.IsTimedout() || nil != req.Error() {
+		t.Fatalf("Expected headers before the deadline, got %v", req.Error())
+	}
+	if body, err := req.GetResponseBody(); nil != err || "late body" != string(body) {
+		t.Errorf("Expected the body read past the deadline, got %q, %v", body, err)
+	}
+}
+
+func TestRequestContextCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	expiring, cancelExpiring := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelExpiring()
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	for _, ctx := range []context.Context{cancelled, expiring} {
+		req, _ := NewHTTPRequest(ctx, server.URL, nil)
+		defer req.Close()
+		mCtx.AddHTTPRequest(req)
+	}
+
+	start := time.Now()
+	mCtx.Execute(context.Background())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request contexts to abort the calls, took %v", elapsed)
+	}
+
+	if req := mCtx.httpRequests[0]; req.IsTimedout() || !errors.Is(req.Error(), context.Canceled) {
+		t.Errorf("Expected the cancelled request to fail, got %v", req.Error())
+	}
+	if req := mCtx.httpRequests[1]; !req.IsTimedout() {
+		t.Errorf("Expected the expired request to time out, got %v", req.Error())
+	}
+}
+
+func TestExecuteDeadlineGoroutines(t *testing.T) {
+	server := newDelayServer()
+	defer server.Close()
+
+	client, _ := NewHTTPClient(ClientConfig{MaxIdleConnsPerHost: 64, MaxHTTPClient: 1})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	before := runtime.NumGoroutine()
+	mCtx := NewMultiHTTPRequestContext(client)
+	for idx := 0; idx < 50; idx++ {
+		req, _ := NewHTTPRequest(context.Background(), server.URL, nil)
+		req.SetTimeout(time.Minute)
+		defer req.Close()
+		mCtx.AddHTTPRequest(req)
+	}
+	mCtx.Execute(ctx)
+
+	// the bodies are not read yet, every connection runs a read and a write
+	// loop in the transport and a handler in the server
+	time.Sleep(10 * time.Millisecond)
+	if goroutines := runtime.NumGoroutine() - before; goroutines > 3*50+10 {
+		t.Errorf("Expected no goroutine per request, got %d for 50 requests", goroutines)
+	}
+}
+
+func TestReadResponseBodyTooLarge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 100))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	req, _ := NewHTTPRequest(ctx, server.URL, nil)
+	defer req.Close()
+
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	if _, err := req.ReadResponseBody(99); ErrResponseTooLarge != err {
+		t.Errorf("Expected ErrResponseTooLarge, got %v", err)
+	}
+}
+
+func TestReadResponseBodyAfterGetResponseBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write(bytes.Repeat([]byte("a"), 100))
+		gw.Close()
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	raw, _ := NewHTTPRequest(ctx, server.URL, nil)
+	decoded, _ := NewHTTPRequest(ctx, server.URL, nil)
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	for _, req := range []*HTTPRequest{raw, decoded} {
+		req.AddHeader("Accept-Encoding", "gzip")
+		defer req.Close()
+		mCtx.AddHTTPRequest(req)
+	}
+	mCtx.Execute(ctx)
+
+	compressed, err := raw.GetResponseBody()
+	if nil != err || len(compressed) >= 100 {
+		t.Fatalf("Expected the compressed body, got %d bytes, %v", len(compressed), err)
+	}
+	if _, err := raw.ReadResponseBody(99); ErrResponseTooLarge != err {
+		t.Errorf("Expected ErrResponseTooLarge, got %v", err)
+	}
+	body, err := raw.ReadResponseBody(100)
+	if nil != err || !bytes.Equal(bytes.Repeat([]byte("a"), 100), body) {
+		t.Errorf("Expected the decoded body, got %q, %v", body, err)
+	}
+
+	if _, err := decoded.ReadResponseBody(0); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := decoded.GetResponseBody(); ErrBodyDecoded != err {
+		t.Errorf("Expected ErrBodyDecoded, got %v", err)
+	}
+}
+
+func TestDecodeJSONAfterReadResponseBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"foo","count":3}`))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	req, _ := NewHTTPRequest(ctx, server.URL, nil)
+	defer req.Close()
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	if _, err := req.ReadResponseBody(0); nil != err {
+		t.Fatal(err)
+	}
+	payload, err := DecodeJSON[testPayload](req, 1024)
+	if nil != err || "foo" != payload.Name || 3 != payload.Count {
+		t.Errorf("Unexpected payload %+v (%v)", payload, err)
+	}
+}
+
+func TestRequestCompression(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		if "gzip" == r.Header.Get("Content-Encoding") {
+			gr, err := gzip.NewReader(r.Body)
+			if nil != err {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gr
+		}
+		data, _ := ioutil.ReadAll(body)
+		w.Header().Set("X-Encoding", r.Header.Get("Content-Encoding"))
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient(ClientConfig{
+		MaxHTTPClient:              1,
+		RequestCompressionMinBytes: 64,
+		RequestCompressionLevel:    gzip.BestSpeed,
+	})
+
+	ctx := context.Background()
+	small, _ := NewHTTPRequest(ctx, server.URL, []byte("[1,2,3]"))
+	large, _ := NewHTTPRequest(ctx, server.URL, bytes.Repeat([]byte("[1,2,3]"), 100))
+	mCtx := NewMultiHTTPRequestContext(client)
+	for _, req := range []*HTTPRequest{small, large} {
+		defer req.Close()
+		mCtx.AddHTTPRequest(req)
+	}
+	mCtx.Execute(ctx)
+
+	if "" != small.response.Header.Get("X-Encoding") {
+		t.Error("Expected small body to be sent uncompressed")
+	}
+	if "gzip" != large.response.Header.Get("X-Encoding") {
+		t.Error("Expected large body to be gzipped")
+	}
+	body, _ := large.GetResponseBody()
+	if 700 != len(body) {
+		t.Errorf("Unexpected echoed body length %d", len(body))
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []string{"X-App", "Authorization", DefaultRequestIDHeader} {
+			w.Header().Set("Echo-"+key, r.Header.Get(key))
+		}
+	}))
+	defer server.Close()
+
+	var order []string
+	trace := func(name string) Interceptor {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				return next.RoundTrip(r)
+			})
+		}
+	}
+
+	client, _ := NewHTTPClient(ClientConfig{
+		MaxHTTPClient: 1,
+		Interceptors: []Interceptor{
+			trace("first"),
+			StaticHeadersInterceptor(map[string]string{"X-App": "connector"}),
+			BearerTokenInterceptor(func(ctx context.Context) (string, error) {
+				return "secret", nil
+			}),
+			RequestIDInterceptor(""),
+			LoggingInterceptor(),
+			trace("last"),
+		},
+	})
+
+	ctx := context.Background()
+	req, _ := NewHTTPRequest(ctx, server.URL, nil)
+	defer req.Close()
+	mCtx := NewMultiHTTPRequestContext(client)
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	if nil != req.Error() {
+		t.Fatal(req.Error())
+	}
+	if 2 != len(order) || "first" != order[0] || "last" != order[1] {
+		t.Errorf("Unexpected interceptor order %v", order)
+	}
+	header := req.response.Header
+	if "connector" != header.Get("Echo-X-App") || "Bearer secret" != header.Get("Echo-Authorization") {
+		t.Errorf("Missing injected headers %v", header)
+	}
+	if "" == header.Get("Echo-"+DefaultRequestIDHeader) {
+		t.Error("Expected request id header to be set")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server := newDelayServer()
+	defer server.Close()
+
+	client := newTestClient(t)
+	ctx := context.Background()
+	for idx := 0; idx < 2; idx++ {
+		req, _ := NewHTTPRequest(ctx, server.URL, nil)
+		mCtx := NewMultiHTTPRequestContext(client)
+		mCtx.AddHTTPRequest(req)
+		mCtx.Execute(ctx)
+		req.GetResponseBody()
+		req.Close()
+
+		timings := req.Timings()
+		if timings.TimeToFirstByte <= 0 {
+			t.Error("Expected time to first byte to be recorded")
+		}
+	}
+
+	// querying an unknown host does not create its series
+	if rejected, delayed := client.Metrics().Throttled("unknown.test"); 0 != rejected || 0 != delayed {
+		t.Errorf("Unexpected throttling of an unknown host %d/%d", rejected, delayed)
+	}
+
+	var buff bytes.Buffer
+	if err := client.Metrics().WritePrometheus(&buff); nil != err {
+		t.Fatal(err)
+	}
+	if strings.Contains(buff.String(), "unknown.test") {
+		t.Errorf("Unexpected series of an unknown host in\n%s", buff.String())
+	}
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	for _, line := range []string{
+		`http_client_requests_total{host="` + host + `",status_class="2xx"} 2`,
+		`http_client_request_duration_seconds_count{host="` + host + `"} 2`,
+		`http_client_timeouts_total{host="` + host + `"} 0`,
+	} {
+		if !strings.Contains(buff.String(), line) {
+			t.Errorf("Missing metric line %s in\n%s", line, buff.String())
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, pemBytes, 0600); nil != err {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, cfg := range []ClientConfig{
+		{MaxHTTPClient: 1, CACertFile: caFile, MinTLSVersion: tls.VersionTLS12},
+		{MaxHTTPClient: 1, InsecureSkipVerify: true, DisableHTTP2: true},
+		{MaxHTTPClient: 1},
+	} {
+		client, err := NewHTTPClient(cfg)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		req, _ := NewHTTPRequest(ctx, server.URL, nil)
+		mCtx := NewMultiHTTPRequestContext(client)
+		mCtx.AddHTTPRequest(req)
+		mCtx.Execute(ctx)
+		req.Close()
+
+		trusted := "" != cfg.CACertFile || cfg.InsecureSkipVerify
+		if trusted && nil != req.Error() {
+			t.Errorf("Unexpected error %v", req.Error())
+		}
+		if !trusted && nil == req.Error() {
+			t.Error("Expected unknown authority error")
+		}
+	}
+
+	if _, err := NewHTTPClient(ClientConfig{MaxHTTPClient: 1, ForceHTTP2: true, DisableHTTP2: true}); ErrConflictingHTTP2 != err {
+		t.Errorf("Expected ErrConflictingHTTP2, got %v", err)
+	}
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	noProxy := []string{"internal.example.com", ".corp", "10.0.0.0/8", "192.168.1.1"}
+	for host, expected := range map[string]bool{
+		"internal.example.com":     true,
+		"api.internal.example.com": true,
+		"example.com":              false,
+		"git.corp":                 true,
+		"10.1.2.3":                 true,
+		"192.168.1.1":              true,
+		"192.168.1.2":              false,
+	} {
+		if expected != matchNoProxy(host, noProxy) {
+			t.Errorf("Unexpected no-proxy match for %s", host)
+		}
+	}
+	if !matchNoProxy("anything", []string{"*"}) {
+		t.Error("Expected wildcard to match every host")
+	}
+}
+
+func TestClientSelection(t *testing.T) {
+	for _, selection := range []ClientSelection{RoundRobinSelection, LeastOutstandingSelection, PowerOfTwoChoicesSelection} {
+		client, _ := NewHTTPClient(ClientConfig{MaxHTTPClient: 4, ClientSelection: selection})
+
+		var releases []func()
+		for idx := 0; idx < 8; idx++ {
+			_, release := client.AcquireClient()
+			releases = append(releases, release)
+		}
+
+		inflight := client.Inflight()
+		var total int64
+		for _, count := range inflight {
+			total += count
+			if selection != PowerOfTwoChoicesSelection && 2 != count {
+				t.Errorf("Expected even load for selection %d, got %v", selection, inflight)
+				break
+			}
+		}
+		if 8 != total {
+			t.Errorf("Expected 8 requests in flight, got %v", inflight)
+		}
+
+		for _, release := range releases {
+			release()
+		}
+		for _, count := range client.Inflight() {
+			if 0 != count {
+				t.Errorf("Expected no request in flight, got %v", client.Inflight())
+			}
+		}
+	}
+}
+
+func TestEndpointBalancing(t *testing.T) {
+	var healthy, failing int32
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "/api/v1/bid" == r.URL.Path && "x=1" == r.URL.RawQuery {
+			atomic.AddInt32(&healthy, 1)
+		}
+	}))
+	defer healthyServer.Close()
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failing, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failingServer.Close()
+
+	client, err := NewHTTPClient(ClientConfig{
+		MaxHTTPClient: 1,
+		Endpoints: []Endpoint{
+			{BaseURL: healthyServer.URL + "/api/"},
+			{BaseURL: failingServer.URL + "/api"},
+		},
+		MaxConsecutiveFailures: 2,
+		EjectionCooldownSec:    60,
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	for idx := 0; idx < 10; idx++ {
+		req, _ := NewHTTPRequest(ctx, "/v1/bid?x=1", nil)
+		mCtx := NewMultiHTTPRequestContext(client)
+		mCtx.AddHTTPRequest(req)
+		mCtx.Execute(ctx)
+		req.Close()
+		if nil != req.Error() {
+			t.Fatal(req.Error())
+		}
+	}
+
+	if 2 != atomic.LoadInt32(&failing) || 8 != atomic.LoadInt32(&healthy) {
+		t.Errorf("Expected failing endpoint to be ejected after 2 failures, got %d/%d", healthy, failing)
+	}
+}
+
+func TestEndpointHealthCheck(t *testing.T) {
+	var down int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if 1 == atomic.LoadInt32(&down) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient(ClientConfig{
+		MaxHTTPClient:          1,
+		Endpoints:              []Endpoint{{BaseURL: server.URL}},
+		HealthCheckPath:        "/health",
+		HealthCheckIntervalMS:  10,
+		MaxConsecutiveFailures: 1,
+		EjectionCooldownSec:    1,
+	})
+	defer client.Close()
+
+	ep := client.balancer.endpoints[0]
+	time.Sleep(50 * time.Millisecond)
+	if ep.available(time.Now().UnixNano()) {
+		t.Fatal("Expected endpoint to be ejected by the health check")
+	}
+
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(50 * time.Millisecond)
+	if 0 != atomic.LoadInt64(&ep.consecutiveFailures) {
+		t.Error("Expected a passing health check to reset the failures")
+	}
+}
+
+func TestClientCloseTwice(t *testing.T) {
+	client, err := NewHTTPClient(ClientConfig{
+		MaxHTTPClient:   1,
+		Endpoints:       []Endpoint{{BaseURL: "http://127.0.0.1:1"}},
+		HealthCheckPath: "/health",
+		DNSCacheTTLSec:  60,
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	client.Close()
+}
+
+func TestEndpointHealthCheckRateLimited(t *testing.T) {
+	server := newDelayServer()
+	defer server.Close()
+
+	client, _ := NewHTTPClient(ClientConfig{
+		MaxHTTPClient:          1,
+		Endpoints:              []Endpoint{{BaseURL: server.URL}},
+		HealthCheckPath:        "/health",
+		HealthCheckIntervalMS:  10,
+		MaxConsecutiveFailures: 1,
+		EjectionCooldownSec:    1,
+		GlobalRateLimit:        RateLimit{QPS: 0.01, Burst: 1},
+		RateLimitMode:          FailOnRateLimit,
+	})
+	defer client.Close()
+
+	// only the first probe gets a token, the next ones are rate limited
+	time.Sleep(50 * time.Millisecond)
+	ep := client.balancer.endpoints[0]
+	if !ep.available(time.Now().UnixNano()) || 0 != atomic.LoadInt64(&ep.consecutiveFailures) {
+		t.Error("Expected rate limited probes not to eject the endpoint")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := newDelayServer()
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, mode := range []RateLimitMode{FailOnRateLimit, BlockOnRateLimit} {
+		client, _ := NewHTTPClient(ClientConfig{
+			MaxHTTPClient:   1,
+			HostRateLimits:  map[string]RateLimit{"127.0.0.1": {QPS: 20, Burst: 2}},
+			GlobalRateLimit: RateLimit{QPS: 1000},
+			RateLimitMode:   mode,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		mCtx := NewMultiHTTPRequestContext(client)
+		for idx := 0; idx < 4; idx++ {
+			req, _ := NewHTTPRequest(ctx, server.URL, nil)
+			defer req.Close()
+			mCtx.AddHTTPRequest(req)
+		}
+		mCtx.Execute(ctx)
+		cancel()
+
+		failed := 0
+		for _, req := range mCtx.httpRequests {
+			if nil != req.Error() {
+				if !errors.Is(req.Error(), ErrRateLimited) {
+					t.Errorf("Expected ErrRateLimited, got %v", req.Error())
+				}
+				failed++
+			}
+		}
+
+		rejected, delayed := client.Metrics().Throttled(host)
+		if FailOnRateLimit == mode && (2 != failed || 2 != rejected) {
+			t.Errorf("Expected 2 rejected requests, got %d (%d counted)", failed, rejected)
+		}
+		if BlockOnRateLimit == mode && (0 != failed || 2 != delayed) {
+			t.Errorf("Expected 2 delayed requests, got %d failed and %d delayed", failed, delayed)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var transitions []string
+	client, _ := NewHTTPClient(ClientConfig{
+		MaxHTTPClient: 1,
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 3,
+			OpenTimeoutMS:    50,
+			OnStateChange: func(host string, from, to CircuitState) {
+				transitions = append(transitions, from.String()+">"+to.String())
+			},
+		},
+	})
+
+	send := func() *HTTPRequest {
+		ctx := context.Background()
+		req, _ := NewHTTPRequest(ctx, server.URL, nil)
+		mCtx := NewMultiHTTPRequestContext(client)
+		mCtx.AddHTTPRequest(req)
+		mCtx.Execute(ctx)
+		req.Close()
+		return req
+	}
+
+	for idx := 0; idx < 5; idx++ {
+		send()
+	}
+	if 3 != atomic.LoadInt32(&calls) || CircuitOpen != client.CircuitState(host) {
+		t.Fatalf("Expected circuit to open after 3 failures, got %d calls", calls)
+	}
+
+	req := send()
+	if !req.IsCircuitOpen() || ErrCircuitOpen != req.Error() || req.IsTimedout() {
+		t.Errorf("Expected request to be short-circuited, got %v", req.Error())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	send()
+	if 4 != atomic.LoadInt32(&calls) || CircuitOpen != client.CircuitState(host) {
+		t.Errorf("Expected a single failing half-open probe, got %d calls", calls)
+	}
+
+	expected := []string{"closed>open", "open>half-open", "half-open>open"}
+	if strings.Join(expected, ",") != strings.Join(transitions, ",") {
+		t.Errorf("Unexpected transitions %v", transitions)
+	}
+}
+
+func TestCircuitBreakerTimeouts(t *testing.T) {
+	server := newDelayServer()
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	send := func(client *HTTPClient, timeout time.Duration) *HTTPRequest {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		req, _ := NewHTTPRequest(context.Background(), server.URL+"?delay=200ms", nil)
+		mCtx := NewMultiHTTPRequestContext(client)
+		mCtx.AddHTTPRequest(req)
+		mCtx.Execute(ctx)
+		req.Close()
+		return req
+	}
+
+	// the Execute deadline
+	client, _ := NewHTTPClient(ClientConfig{
+		MaxHTTPClient:  1,
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2},
+	})
+	defer client.Close()
+	for idx := 0; idx < 2; idx++ {
+		if req := send(client, 20*time.Millisecond); !req.IsTimedout() {
+			t.Fatalf("Expected request to time out, got %v", req.Error())
+		}
+	}
+	if req := send(client, 20*time.Millisecond); !req.IsCircuitOpen() {
+		t.Errorf("Expected circuit to open after 2 deadline timeouts, got %v", req.Error())
+	}
+
+	// the client timeout only
+	client, _ = NewHTTPClient(ClientConfig{
+		MaxHTTPClient:    1,
+		RequestTimeoutMS: 20,
+		CircuitBreaker:   CircuitBreakerConfig{FailureThreshold: 2},
+	})
+	defer client.Close()
+	for idx := 0; idx < 2; idx++ {
+		send(client, 0)
+	}
+	if CircuitOpen != client.CircuitState(host) {
+		t.Errorf("Expected circuit to open after 2 client timeouts, got %v", client.CircuitState(host))
+	}
+	if req := send(client, 0); !req.IsCircuitOpen() {
+		t.Errorf("Expected request to be short-circuited, got %v", req.Error())
+	}
+}
+
+func TestResponseBodyReleasedOnClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pooled body"))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	req, _ := NewHTTPRequest(ctx, server.URL, nil)
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	body, err := req.GetResponseBody()
+	if nil != err || "pooled body" != string(body) {
+		t.Fatalf("Unexpected body %q (%v)", body, err)
+	}
+	again, _ := req.GetResponseBody()
+	if string(body) != string(again) {
+		t.Error("Expected body to be returned again before Close")
+	}
+
+	req.Close()
+	req.Close()
+	if nil != req.body {
+		t.Error("Expected body buffer to be released on Close")
+	}
+}
+
+func newBenchmarkResponse(body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// baseline reading the body the way GetResponseBody used to
+func BenchmarkReadAllResponseBody(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 16<<10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		response := newBenchmarkResponse(payload)
+		if _, err := ioutil.ReadAll(response.Body); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetResponseBody(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 16<<10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := &HTTPRequest{response: newBenchmarkResponse(payload)}
+		if _, err := req.GetResponseBody(); nil != err {
+			b.Fatal(err)
+		}
+		req.Close()
+	}
+}
+
+func BenchmarkExecute(b *testing.B) {
+	benchmarkExecute(b, context.Background())
+}
+
+func BenchmarkExecuteDeadline(b *testing.B) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	benchmarkExecute(b, ctx)
+}
+
+func benchmarkExecute(b *testing.B, ctx context.Context) {
+	payload := bytes.Repeat([]byte("x"), 4<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient(ClientConfig{
+		MaxIdleConnsPerHost: 64,
+		MaxHTTPClient:       4,
+		RequestTimeoutMS:    1000,
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mCtx := NewMultiHTTPRequestContext(client)
+		for idx := 0; idx < 16; idx++ {
+			req, _ := NewHTTPRequest(ctx, server.URL, nil)
+			mCtx.AddHTTPRequest(req)
+		}
+		mCtx.Execute(ctx)
+		for _, req := range mCtx.httpRequests {
+			req.GetResponseBody()
+			req.Close()
+		}
+	}
+}
+
+func TestNDJSONReader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"name\":\"a\",\"count\":1}\n\n{\"name\":\"b\",\"count\":2}\n{\"name\":\"c\",\"count\":3}"))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	req, _ := NewHTTPRequest(ctx, server.URL, nil)
+	defer req.Close()
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	reader, err := NewNDJSONReader[testPayload](ctx, req)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for reader.Next() {
+		names = append(names, reader.Value().Name)
+	}
+	if nil != reader.Err() || "a,b,c" != strings.Join(names, ",") {
+		t.Errorf("Unexpected values %v (%v)", names, reader.Err())
+	}
+}
+
+func TestNDJSONReaderClose(t *testing.T) {
+	gone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(gone)
+		w.Write([]byte("{\"name\":\"a\",\"count\":1}\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	req, _ := NewHTTPRequest(ctx, server.URL, nil)
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	reader, err := NewNDJSONReader[testPayload](ctx, req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !reader.Next() || "a" != reader.Value().Name {
+		t.Fatalf("Expected a first value, got %v", reader.Err())
+	}
+
+	// the stream never ends, stop early
+	reader.Close()
+	if reader.Next() || nil != reader.Err() {
+		t.Errorf("Expected the iteration to stop, got %v", reader.Err())
+	}
+	select {
+	case <-gone:
+	case <-time.After(time.Second):
+		t.Error("Expected the connection to be released")
+	}
+}
+
+func TestSSEReaderReconnects(t *testing.T) {
+	var connections int32
+	lastEventIDs := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastEventIDs <- r.Header.Get("Last-Event-ID")
+		w.Header().Set("Content-Type", "text/event-stream")
+		if 1 == atomic.AddInt32(&connections, 1) {
+			w.Write([]byte(": comment\nretry: 10\nid: 1\nevent: bid\ndata: first\ndata: line\n\nid: 2\ndata: second\n\n"))
+			return
+		}
+		w.Write([]byte("id: 3\ndata: third\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := NewHTTPRequest(ctx, server.URL, nil)
+	reader := NewSSEReader(ctx, newTestClient(t), req)
+	defer reader.Close()
+
+	var events []SSEEvent
+	for reader.Next() {
+		events = append(events, reader.Event())
+		if 3 == len(events) {
+			cancel()
+		}
+	}
+
+	if nil != reader.Err() {
+		t.Fatal(reader.Err())
+	}
+	if 3 != len(events) {
+		t.Fatalf("Expected 3 events, got %+v", events)
+	}
+	if "bid" != events[0].Event || "first\nline" != events[0].Data || "1" != events[0].ID || 10*time.Millisecond != events[0].Retry {
+		t.Errorf("Unexpected first event %+v", events[0])
+	}
+	if "message" != events[1].Event || "third" != events[2].Data {
+		t.Errorf("Unexpected events %+v", events)
+	}
+	if "" != <-lastEventIDs || "2" != <-lastEventIDs {
+		t.Error("Expected reconnection to send Last-Event-ID")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Tenant", r.Header.Get("X-Tenant"))
+		w.Write(append([]byte("echo:"), data...))
+	}))
+	fixtureDir := t.TempDir()
+
+	send := func(client *HTTPClient, timeout time.Duration, tenant string) *HTTPRequest {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, _ := NewHTTPRequest(ctx, server.URL+"/bid", []byte(`{"id":1}`))
+		req.AddHeader("X-Tenant", tenant)
+		mCtx := NewMultiHTTPRequestContext(client)
+		mCtx.AddHTTPRequest(req)
+		mCtx.Execute(ctx)
+		return req
+	}
+
+	newClient := func(cfg RecorderConfig) *HTTPClient {
+		cfg.FixtureDir = fixtureDir
+		cfg.MatchHeaders = []string{"X-Tenant"}
+		client, _ := NewHTTPClient(ClientConfig{
+			MaxHTTPClient: 1,
+			Interceptors:  []Interceptor{NewRecorder(cfg).Interceptor()},
+		})
+		return client
+	}
+
+	recorded := send(newClient(RecorderConfig{Mode: RecordMode}), time.Second, "a")
+	recorded.Close()
+	if nil != recorded.Error() {
+		t.Fatal(recorded.Error())
+	}
+	server.Close()
+
+	replayer := newClient(RecorderConfig{Mode: ReplayMode, Latency: 5 * time.Millisecond})
+	replayed := send(replayer, time.Second, "a")
+	defer replayed.Close()
+	body, _ := replayed.GetResponseBody()
+	if `echo:{"id":1}` != string(body) || "a" != replayed.response.Header.Get("X-Tenant") {
+		t.Errorf("Unexpected replayed response %q", body)
+	}
+
+	if missing := send(replayer, time.Second, "b"); !errors.Is(missing.Error(), ErrFixtureNotFound) {
+		t.Errorf("Expected ErrFixtureNotFound for an unmatched header, got %v", missing.Error())
+	}
+
+	for fault, check := range map[FaultType]func(req *HTTPRequest) bool{
+		TimeoutFault:         func(req *HTTPRequest) bool { return req.IsTimedout() },
+		ServerErrorFault:     func(req *HTTPRequest) bool { return http.StatusServiceUnavailable == req.ResponseStatusCode() },
+		ConnectionResetFault: func(req *HTTPRequest) bool { return errors.Is(req.Error(), syscall.ECONNRESET) },
+	} {
+		faulty := newClient(RecorderConfig{Mode: ReplayMode, FaultRate: 1, FaultType: fault})
+		req := send(faulty, 50*time.Millisecond, "a")
+		req.Close()
+		if !check(req) {
+			t.Errorf("Fault %d not injected, got %v", fault, req.Error())
+		}
+	}
+}
+
+func TestOAuth2TokenSource(t *testing.T) {
+	var tokenRequests int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		if "client" != id || "secret" != secret || "client_credentials" != r.Form.Get("grant_type") || "read write" != r.Form.Get("scope") {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		count := atomic.AddInt32(&tokenRequests, 1)
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`, count)
+	}))
+	defer tokenServer.Close()
+
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "Bearer token-1" != r.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer apiServer.Close()
+
+	ts := NewOAuth2TokenSource(OAuth2Config{
+		TokenURL:     tokenServer.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"read", "write"},
+	})
+	client, _ := NewHTTPClient(ClientConfig{MaxHTTPClient: 2, Interceptors: []Interceptor{ts.Interceptor()}})
+
+	ctx := context.Background()
+	mCtx := NewMultiHTTPRequestContext(client)
+	for idx := 0; idx < 10; idx++ {
+		req, _ := NewHTTPRequest(ctx, apiServer.URL, nil)
+		defer req.Close()
+		mCtx.AddHTTPRequest(req)
+	}
+	mCtx.Execute(ctx)
+
+	for _, req := range mCtx.httpRequests {
+		if http.StatusOK != req.ResponseStatusCode() {
+			t.Fatalf("Unexpected status %d (%v)", req.ResponseStatusCode(), req.Error())
+		}
+	}
+	if 1 != atomic.LoadInt32(&tokenRequests) {
+		t.Errorf("Expected a single token request, got %d", tokenRequests)
+	}
+
+	bad := NewOAuth2TokenSource(OAuth2Config{TokenURL: tokenServer.URL, ClientID: "client", ClientSecret: "wrong"})
+	var oauthErr *OAuth2Error
+	if _, err := bad.Token(ctx); !errors.As(err, &oauthErr) || "invalid_client" != oauthErr.Code {
+		t.Errorf("Expected invalid_client error, got %v", err)
+	}
+}
+
+func TestOAuth2ShortLivedToken(t *testing.T) {
+	var tokenRequests int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&tokenRequests, 1)
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":10}`, count)
+	}))
+	defer tokenServer.Close()
+
+	// the 30 seconds default margin exceeds the token lifetime
+	ts := NewOAuth2TokenSource(OAuth2Config{TokenURL: tokenServer.URL})
+	ctx := context.Background()
+	for idx := 0; idx < 5; idx++ {
+		if token, err := ts.Token(ctx); nil != err || "token-1" != token {
+			t.Fatalf("Unexpected token %s (%v)", token, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if 1 != atomic.LoadInt32(&tokenRequests) {
+		t.Errorf("Expected a single token request, got %d", tokenRequests)
+	}
+}
+
+func TestMultipartRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength <= 0 || 0 != len(r.TransferEncoding) {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		if err := r.ParseMultipartForm(1 << 20); nil != err {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("report")
+		if nil != err {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		fmt.Fprintf(w, "%s|%s|%s", r.FormValue("campaign"), header.Filename, data)
+	}))
+	defer server.Close()
+
+	reportFile := filepath.Join(t.TempDir(), "report.csv")
+	ioutil.WriteFile(reportFile, []byte("id,clicks\n1,10\n"), 0600)
+
+	var sent, total int64
+	ctx := context.Background()
+	req, err := NewMultipartRequest(ctx, server.URL).
+		AddField("campaign", "42").
+		AddFile("report", reportFile).
+		OnProgress(func(s, t int64) { sent, total = s, t }).
+		Build()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer req.Close()
+
+	mCtx := NewMultiHTTPRequestContext(newTestClient(t))
+	mCtx.AddHTTPRequest(req)
+	mCtx.Execute(ctx)
+
+	body, _ := req.GetResponseBody()
+	if http.StatusOK != req.ResponseStatusCode() || "42|report.csv|id,clicks\n1,10\n" != string(body) {
+		t.Errorf("Unexpected response %d %q", req.ResponseStatusCode(), body)
+	}
+	if 0 == total || sent != total {
+		t.Errorf("Expected progress to reach the total size, got %d/%d", sent, total)
+	}
+
+	if _, err := NewMultipartRequest(ctx, server.URL).AddFile("report", reportFile+".missing").Build(); nil == err {
+		t.Error("Expected missing file error")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	server := newDelayServer()
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	client, err := NewHTTPClient(ClientConfig{
+		MaxIdleConnsPerHost: 10,
+		MaxConnsPerHost:     10,
+		RequestTimeoutMS:    1000,
+		ConnectionTimeoutMS: 100,
+		MaxHTTPClient:       1,
+		DNSCacheTTLSec:      60,
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var lookups int64
+	var failing int32
+	client.dnsCache.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		atomic.AddInt64(&lookups, 1)
+		if 1 == atomic.LoadInt32(&failing) || "backend.test" != host {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+
+	execute := func() *HTTPRequest {
+		req, err := NewHTTPRequest(context.Background(), "http://backend.test:"+port+"/", nil)
+		if nil != err {
+			t.Fatal(err)
+		}
+		req.request.Close = true // force a new dial for every request
+		mCtx := NewMultiHTTPRequestContext(client)
+		mCtx.AddHTTPRequest(req)
+		mCtx.Execute(context.Background())
+		return req
+	}
+
+	for i := 0; i < 3; i++ {
+		req := execute()
+		if http.StatusOK != req.ResponseStatusCode() {
+			t.Fatalf("Unexpected response %d: %v", req.ResponseStatusCode(), req.err)
+		}
+		req.Close()
+	}
+	if 1 != atomic.LoadInt64(&lookups) {
+		t.Errorf("Expected a single lookup, got %d", lookups)
+	}
+
+	// an expired entry keeps being used while the resolver fails
+	atomic.StoreInt32(&failing, 1)
+	client.dnsCache.mu.Lock()
+	client.dnsCache.entries["backend.test"].expiry = time.Now().Add(-time.Second)
+	client.dnsCache.mu.Unlock()
+
+	req := execute()
+	defer req.Close()
+	if http.StatusOK != req.ResponseStatusCode() {
+		t.Errorf("Expected the stale address to be used, got %d: %v", req.ResponseStatusCode(), req.err)
+	}
+	for idx := 0; idx < 100 && 2 != atomic.LoadInt64(&lookups); idx++ {
+		time.Sleep(time.Millisecond)
+	}
+	if 2 != atomic.LoadInt64(&lookups) {
+		t.Errorf("Expected a lookup of the expired entry, got %d", lookups)
+	}
+}
+
+func TestDNSCacheHangingResolver(t *testing.T) {
+	cache := newDNSCache(time.Minute, 0)
+	defer close(cache.stop)
+
+	release := make(chan struct{})
+	defer close(release)
+	var lookups int64
+	cache.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		atomic.AddInt64(&lookups, 1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil, ctx.Err()
+	}
+	cache.entries["backend.test"] = &dnsEntry{
+		addrs:  []string{"127.0.0.1"},
+		expiry: time.Now().Add(-time.Second),
+	}
+
+	// the expired entry is served right away, a single lookup runs behind
+	for idx := 0; idx < 3; idx++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		entry, err := cache.lookup(ctx, "backend.test")
+		cancel()
+		if nil != err || "127.0.0.1" != entry.addrs[0] {
+			t.Fatalf("Expected the stale entry, got %v", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if 1 != atomic.LoadInt64(&lookups) {
+		t.Errorf("Expected a single background lookup, got %d", lookups)
+	}
+
+	// an unknown host blocks until the dial deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cache.lookup(ctx, "other.test"); context.DeadlineExceeded != err {
+		t.Errorf("Expected the deadline to expire, got %v", err)
+	}
+}
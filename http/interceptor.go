@@ -0,0 +1,129 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iacuity/datastore-connector/log"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRequestIDHeader = "X-Request-Id"
+)
+
+// RoundTripperFunc adapts an ordinary function to http.RoundTripper
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Interceptor is a RoundTripper middleware, it receives the next RoundTripper
+// of the chain and returns the one wrapping it.
+// as for any RoundTripper, interceptors must not modify the given request,
+// clone it before adding headers
+type Interceptor func(next http.RoundTripper) http.RoundTripper
+
+// wrap transport with the given interceptors, the first interceptor is the
+// outermost one and therefore sees the request first
+func chainInterceptors(transport http.RoundTripper, interceptors []Interceptor) http.RoundTripper {
+	for idx := len(interceptors) - 1; idx >= 0; idx-- {
+		transport = interceptors[idx](transport)
+	}
+	return transport
+}
+
+// set the given headers on every request that does not already carry them
+func StaticHeadersInterceptor(headers map[string]string) Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r = r.Clone(r.Context())
+			for key, value := range headers {
+				if "" == r.Header.Get(key) {
+					r.Header.Set(key, value)
+				}
+			}
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// set the Authorization header to the bearer token returned by token,
+// the request fails with the error returned by token if any
+func BearerTokenInterceptor(token func(ctx context.Context) (string, error)) Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			value, err := token(r.Context())
+			if nil != err {
+				if nil != r.Body {
+					r.Body.Close()
+				}
+				return nil, err
+			}
+
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+value)
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// set a random request id in the given header (DefaultRequestIDHeader if
+// empty) unless the request already carries one
+func RequestIDInterceptor(header string) Interceptor {
+	if "" == header {
+		header = DefaultRequestIDHeader
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if "" == r.Header.Get(header) {
+				r = r.Clone(r.Context())
+				r.Header.Set(header, uuid.NewString())
+			}
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// log every request with its outcome through the log package,
+// failed requests are logged at error level and the others at debug level.
+// nothing is logged until log.Init has been called
+func LoggingInterceptor() Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			startTime := time.Now()
+			response, err := next.RoundTrip(r)
+
+			logger := log.Log()
+			if nil == logger {
+				return response, err
+			}
+
+			fields := []zap.Field{
+				zap.String("method", r.Method),
+				zap.String("url", r.URL.String()),
+				zap.Duration("duration", time.Since(startTime)),
+			}
+			if requestID := r.Header.Get(DefaultRequestIDHeader); "" != requestID {
+				fields = append(fields, zap.String("requestId", requestID))
+			}
+
+			if nil != err {
+				logger.Error("http request failed", append(fields, zap.Error(err))...)
+			} else {
+				fields = append(fields, zap.Int("status", response.StatusCode))
+				if response.StatusCode >= http.StatusInternalServerError {
+					logger.Error("http request failed", fields...)
+				} else {
+					logger.Debug("http request", fields...)
+				}
+			}
+
+			return response, err
+		})
+	}
+}
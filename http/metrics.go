@@ -0,0 +1,292 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds (in seconds) of the request latency histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// RequestTimings holds the phase timings of a single request,
+// phases that did not happen (e.g. DNS for a reused connection) are 0
+type RequestTimings struct {
+	DNS             time.Duration
+	Connect         time.Duration
+	TLSHandshake    time.Duration
+	TimeToFirstByte time.Duration
+	BodyRead        time.Duration
+	ConnReused      bool
+}
+
+// phaseTracer collects RequestTimings through httptrace hooks
+type phaseTracer struct {
+	mu        sync.Mutex
+	timings   RequestTimings
+	startTime time.Time
+	dnsStart  time.Time
+	dialStart time.Time
+	tlsStart  time.Time
+}
+
+func newPhaseTracer() *phaseTracer {
+	return &phaseTracer{startTime: time.Now()}
+}
+
+// return the request context with the tracer hooks attached
+func (pt *phaseTracer) withContext(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			pt.mu.Lock()
+			pt.dnsStart = time.Now()
+			pt.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			pt.mu.Lock()
+			pt.timings.DNS = time.Since(pt.dnsStart)
+			pt.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			pt.mu.Lock()
+			pt.dialStart = time.Now()
+			pt.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			pt.mu.Lock()
+			pt.timings.Connect = time.Since(pt.dialStart)
+			pt.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			pt.mu.Lock()
+			pt.tlsStart = time.Now()
+			pt.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			pt.mu.Lock()
+			pt.timings.TLSHandshake = time.Since(pt.tlsStart)
+			pt.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			pt.mu.Lock()
+			pt.timings.ConnReused = info.Reused
+			pt.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			pt.mu.Lock()
+			pt.timings.TimeToFirstByte = time.Since(pt.startTime)
+			pt.mu.Unlock()
+		},
+	})
+}
+
+func (pt *phaseTracer) result() RequestTimings {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.timings
+}
+
+// return the phase timings of the request, BodyRead is only set once the
+// body has been read through one of the HTTPRequest helpers
+func (req *HTTPRequest) Timings() RequestTimings {
+	return req.timings
+}
+
+// hostMetrics are the aggregated counters of a single destination host,
+// all fields are updated atomically
+type hostMetrics struct {
+	statusClasses [5]uint64 // 1xx to 5xx
+	errors        uint64
+	timeouts      uint64
+	connReused    uint64
+	connNew       uint64
+	latencySumNS  uint64
+	latencyCount  uint64
+	throttled     uint64   // rejected by the rate limiter
+	delayed       uint64   // delayed by the rate limiter
+	buckets       []uint64 // cumulative counts per latencyBuckets entry
+}
+
+// Metrics aggregates outbound request metrics per destination host
+type Metrics struct {
+	hosts sync.Map // host -> *hostMetrics
+}
+
+func (m *Metrics) host(host string) *hostMetrics {
+	if hm, ok := m.hosts.Load(host); ok {
+		return hm.(*hostMetrics)
+	}
+
+	hm, _ := m.hosts.LoadOrStore(host, &hostMetrics{buckets: make([]uint64, len(latencyBuckets))})
+	return hm.(*hostMetrics)
+}
+
+func (m *Metrics) record(host string, statusCode int, err error, latency time.Duration, reused, gotConn bool) {
+	hm := m.host(host)
+
+	if nil != err {
+		atomic.AddUint64(&hm.errors, 1)
+		if isTimeoutError(err) {
+			atomic.AddUint64(&hm.timeouts, 1)
+		}
+	} else if class := statusCode / 100; class >= 1 && class <= 5 {
+		atomic.AddUint64(&hm.statusClasses[class-1], 1)
+	}
+
+	if gotConn {
+		if reused {
+			atomic.AddUint64(&hm.connReused, 1)
+		} else {
+			atomic.AddUint64(&hm.connNew, 1)
+		}
+	}
+
+	atomic.AddUint64(&hm.latencySumNS, uint64(latency))
+	atomic.AddUint64(&hm.latencyCount, 1)
+	seconds := latency.Seconds()
+	for idx, bound := range latencyBuckets {
+		if seconds <= bound {
+			atomic.AddUint64(&hm.buckets[idx], 1)
+		}
+	}
+}
+
+// return the number of requests to host rejected and delayed by the rate limiter
+func (m *Metrics) Throttled(host string) (rejected, delayed uint64) {
+	value, ok := m.hosts.Load(host)
+	if !ok {
+		return 0, 0
+	}
+	hm := value.(*hostMetrics)
+	return atomic.LoadUint64(&hm.throttled), atomic.LoadUint64(&hm.delayed)
+}
+
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, reqTimeoutError) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// write the metrics in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	hosts := make([]string, 0)
+	m.hosts.Range(func(key, value any) bool {
+		hosts = append(hosts, key.(string))
+		return true
+	})
+	sort.Strings(hosts)
+
+	bw := &errWriter{w: w}
+	bw.printf("# HELP http_client_requests_total Completed outbound requests by status class.\n")
+	bw.printf("# TYPE http_client_requests_total counter\n")
+	for _, host := range hosts {
+		hm := m.host(host)
+		for idx := range hm.statusClasses {
+			bw.printf("http_client_requests_total{host=%q,status_class=\"%dxx\"} %d\n",
+				host, idx+1, atomic.LoadUint64(&hm.statusClasses[idx]))
+		}
+	}
+
+	bw.printf("# HELP http_client_errors_total Outbound requests that failed without a response.\n")
+	bw.printf("# TYPE http_client_errors_total counter\n")
+	for _, host := range hosts {
+		bw.printf("http_client_errors_total{host=%q} %d\n", host, atomic.LoadUint64(&m.host(host).errors))
+	}
+
+	bw.printf("# HELP http_client_timeouts_total Outbound requests that timed out.\n")
+	bw.printf("# TYPE http_client_timeouts_total counter\n")
+	for _, host := range hosts {
+		bw.printf("http_client_timeouts_total{host=%q} %d\n", host, atomic.LoadUint64(&m.host(host).timeouts))
+	}
+
+	bw.printf("# HELP http_client_connections_total Connections used by outbound requests.\n")
+	bw.printf("# TYPE http_client_connections_total counter\n")
+	for _, host := range hosts {
+		hm := m.host(host)
+		bw.printf("http_client_connections_total{host=%q,reused=\"true\"} %d\n", host, atomic.LoadUint64(&hm.connReused))
+		bw.printf("http_client_connections_total{host=%q,reused=\"false\"} %d\n", host, atomic.LoadUint64(&hm.connNew))
+	}
+
+	bw.printf("# HELP http_client_throttled_total Outbound requests rejected or delayed by the rate limiter.\n")
+	bw.printf("# TYPE http_client_throttled_total counter\n")
+	for _, host := range hosts {
+		hm := m.host(host)
+		bw.printf("http_client_throttled_total{host=%q,action=\"rejected\"} %d\n", host, atomic.LoadUint64(&hm.throttled))
+		bw.printf("http_client_throttled_total{host=%q,action=\"delayed\"} %d\n", host, atomic.LoadUint64(&hm.delayed))
+	}
+
+	bw.printf("# HELP http_client_request_duration_seconds Outbound request latency.\n")
+	bw.printf("# TYPE http_client_request_duration_seconds histogram\n")
+	for _, host := range hosts {
+		hm := m.host(host)
+		for idx, bound := range latencyBuckets {
+			bw.printf("http_client_request_duration_seconds_bucket{host=%q,le=\"%g\"} %d\n",
+				host, bound, atomic.LoadUint64(&hm.buckets[idx]))
+		}
+		count := atomic.LoadUint64(&hm.latencyCount)
+		bw.printf("http_client_request_duration_seconds_bucket{host=%q,le=\"+Inf\"} %d\n", host, count)
+		bw.printf("http_client_request_duration_seconds_sum{host=%q} %g\n",
+			host, time.Duration(atomic.LoadUint64(&hm.latencySumNS)).Seconds())
+		bw.printf("http_client_request_duration_seconds_count{host=%q} %d\n", host, count)
+	}
+
+	return bw.err
+}
+
+// errWriter keeps the first write error so the caller checks it only once
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...any) {
+	if nil == ew.err {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
+
+// metricsTransport records every round trip into Metrics
+type metricsTransport struct {
+	next    http.RoundTripper
+	metrics *Metrics
+}
+
+func (t *metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var reused, gotConn int32
+	ctx := httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.StoreInt32(&reused, 1)
+			}
+			atomic.StoreInt32(&gotConn, 1)
+		},
+	})
+
+	startTime := time.Now()
+	response, err := t.next.RoundTrip(r.WithContext(ctx))
+
+	statusCode := 0
+	if nil != response {
+		statusCode = response.StatusCode
+	}
+	recorded := err
+	if executeErr := executeContextErr(r.Context()); nil != err && nil != executeErr {
+		// cancelled by the expiry of the Execute context
+		recorded = executeErr
+	}
+	t.metrics.record(r.URL.Host, statusCode, recorded, time.Since(startTime),
+		1 == atomic.LoadInt32(&reused), 1 == atomic.LoadInt32(&gotConn))
+
+	return response, err
+}
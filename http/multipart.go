@@ -0,0 +1,219 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// MultipartBuilder builds multipart/form-data requests whose files are
+// streamed from disk while the request is sent instead of being buffered.
+// the Content-Length is set whenever the size of every part is known so the
+// upload works with servers rejecting chunked requests
+//
+//	req, err := http.NewMultipartRequest(ctx, url).
+//		AddField("campaign", "42").
+//		AddFile("report", "/tmp/report.csv").
+//		OnProgress(func(sent, total int64) {}).
+//		Build()
+type MultipartBuilder struct {
+	ctx      context.Context
+	url      string
+	method   string
+	buff     bytes.Buffer
+	writer   *multipart.Writer
+	segments []io.Reader
+	size     int64 // -1 once a part of unknown size is added
+	progress func(sent, total int64)
+	closers  []io.Closer
+	err      error
+}
+
+func NewMultipartRequest(ctx context.Context, url string) *MultipartBuilder {
+	b := &MultipartBuilder{
+		ctx:    ctx,
+		url:    url,
+		method: http.MethodPost,
+	}
+	b.writer = multipart.NewWriter(&b.buff)
+	return b
+}
+
+// set the request method, POST by default
+func (b *MultipartBuilder) Method(method string) *MultipartBuilder {
+	b.method = method
+	return b
+}
+
+func (b *MultipartBuilder) AddField(name, value string) *MultipartBuilder {
+	if nil == b.err {
+		b.err = b.writer.WriteField(name, value)
+	}
+	return b
+}
+
+// add the file at filePath, it is opened only when the body is sent
+func (b *MultipartBuilder) AddFile(fieldName, filePath string) *MultipartBuilder {
+	if nil != b.err {
+		return b
+	}
+
+	info, err := os.Stat(filePath)
+	if nil != err {
+		b.err = err
+		return b
+	}
+
+	file := &lazyFile{path: filePath}
+	b.closers = append(b.closers, file)
+	return b.addPart(fieldName, filepath.Base(filePath), file, info.Size())
+}
+
+// add the content of reader as a file, size is -1 if unknown in which case
+// the request is sent chunked
+func (b *MultipartBuilder) AddReader(fieldName, fileName string, reader io.Reader, size int64) *MultipartBuilder {
+	if nil != b.err {
+		return b
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		b.closers = append(b.closers, closer)
+	}
+	return b.addPart(fieldName, fileName, reader, size)
+}
+
+// report the upload progress, total is -1 when the size is unknown
+func (b *MultipartBuilder) OnProgress(progress func(sent, total int64)) *MultipartBuilder {
+	b.progress = progress
+	return b
+}
+
+func (b *MultipartBuilder) addPart(fieldName, fileName string, reader io.Reader, size int64) *MultipartBuilder {
+	if _, b.err = b.writer.CreateFormFile(fieldName, fileName); nil != b.err {
+		return b
+	}
+
+	// the part header is rendered in the buffer, the content is streamed
+	b.flush()
+	b.segments = append(b.segments, reader)
+	if size < 0 || b.size < 0 {
+		b.size = -1
+	} else {
+		b.size += size
+	}
+	return b
+}
+
+// move the rendered bytes out of the buffer into a body segment
+func (b *MultipartBuilder) flush() {
+	if b.buff.Len() > 0 {
+		rendered := make([]byte, b.buff.Len())
+		copy(rendered, b.buff.Bytes())
+		b.buff.Reset()
+		b.segments = append(b.segments, bytes.NewReader(rendered))
+		if b.size >= 0 {
+			b.size += int64(len(rendered))
+		}
+	}
+}
+
+// return the request streaming all parts added so far
+func (b *MultipartBuilder) Build() (*HTTPRequest, error) {
+	if nil == b.err {
+		b.err = b.writer.Close()
+	}
+	if nil != b.err {
+		b.close()
+		return nil, b.err
+	}
+	b.flush()
+
+	body := &multipartBody{
+		reader:   io.MultiReader(b.segments...),
+		closers:  b.closers,
+		total:    b.size,
+		progress: b.progress,
+	}
+
+	request, err := http.NewRequestWithContext(b.ctx, b.method, b.url, body)
+	if nil != err {
+		b.close()
+		return nil, err
+	}
+	request.ContentLength = b.size
+	request.Header.Set("Content-Type", b.writer.FormDataContentType())
+
+	return &HTTPRequest{request: request}, nil
+}
+
+func (b *MultipartBuilder) close() {
+	for _, closer := range b.closers {
+		closer.Close()
+	}
+}
+
+// multipartBody streams the parts and reports the progress
+type multipartBody struct {
+	reader   io.Reader
+	closers  []io.Closer
+	sent     int64
+	total    int64
+	progress func(sent, total int64)
+}
+
+func (body *multipartBody) Read(p []byte) (int, error) {
+	n, err := body.reader.Read(p)
+	if n > 0 {
+		body.sent += int64(n)
+		if nil != body.progress {
+			body.progress(body.sent, body.total)
+		}
+	}
+	return n, err
+}
+
+func (body *multipartBody) Close() error {
+	for _, closer := range body.closers {
+		closer.Close()
+	}
+	return nil
+}
+
+// lazyFile opens the file on first read and closes it at the end
+type lazyFile struct {
+	path string
+	file *os.File
+	done bool
+}
+
+func (lf *lazyFile) Read(p []byte) (int, error) {
+	if lf.done {
+		return 0, io.EOF
+	}
+	if nil == lf.file {
+		file, err := os.Open(lf.path)
+		if nil != err {
+			return 0, err
+		}
+		lf.file = file
+	}
+
+	n, err := lf.file.Read(p)
+	if io.EOF == err {
+		lf.Close()
+	}
+	return n, err
+}
+
+func (lf *lazyFile) Close() error {
+	lf.done = true
+	if nil != lf.file {
+		err := lf.file.Close()
+		lf.file = nil
+		return err
+	}
+	return nil
+}
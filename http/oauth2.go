@@ -0,0 +1,213 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultTokenExpiryMargin   = 30 * time.Second
+	defaultTokenRequestTimeout = 10 * time.Second
+)
+
+var (
+	ErrInvalidTokenResponse = errors.New("Invalid OAuth2 Token Response")
+)
+
+// OAuth2Error is the error returned by the token endpoint
+type OAuth2Error struct {
+	StatusCode  int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *OAuth2Error) Error() string {
+	return fmt.Sprintf("OAuth2 token request failed (%d): %s %s", e.StatusCode, e.Code, e.Description)
+}
+
+type OAuth2Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// extra form values sent to the token endpoint (e.g. audience)
+	EndpointParams map[string]string
+	// send the client credentials in the form instead of the basic auth header
+	CredentialsInBody bool
+	// tokens are refreshed this long before they expire, 0 means 30 seconds.
+	// it is capped at half the token lifetime
+	ExpiryMargin time.Duration
+	// client used to call the token endpoint, nil means a client with a
+	// 10 seconds timeout
+	HTTPClient *http.Client
+}
+
+// OAuth2TokenSource fetches OAuth2 client-credentials tokens and caches them
+// until shortly before they expire.
+// a token entering the expiry margin is still returned while a single
+// background request refreshes it, so callers only wait when there is no
+// usable token at all
+type OAuth2TokenSource struct {
+	cfg    OAuth2Config
+	client *http.Client
+	group  singleflight.Group
+
+	mu        sync.RWMutex
+	token     string
+	expiry    time.Time
+	refreshAt time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func NewOAuth2TokenSource(cfg OAuth2Config) *OAuth2TokenSource {
+	if 0 == cfg.ExpiryMargin {
+		cfg.ExpiryMargin = defaultTokenExpiryMargin
+	}
+
+	client := cfg.HTTPClient
+	if nil == client {
+		client = &http.Client{Timeout: defaultTokenRequestTimeout}
+	}
+
+	return &OAuth2TokenSource{cfg: cfg, client: client}
+}
+
+// return a valid access token, fetching a new one if needed
+func (ts *OAuth2TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.RLock()
+	token, expiry, refreshAt := ts.token, ts.expiry, ts.refreshAt
+	ts.mu.RUnlock()
+
+	now := time.Now()
+	if "" != token && now.Before(expiry) {
+		if !now.Before(refreshAt) {
+			// refresh ahead of expiry without making the caller wait
+			ts.group.DoChan("token", ts.refresh)
+		}
+		return token, nil
+	}
+
+	select {
+	case result := <-ts.group.DoChan("token", ts.refresh):
+		if nil != result.Err {
+			return "", result.Err
+		}
+		return result.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// drop the cached token so the next call to Token fetches a new one,
+// e.g. after the token was revoked
+func (ts *OAuth2TokenSource) Invalidate() {
+	ts.mu.Lock()
+	ts.token = ""
+	ts.expiry = time.Time{}
+	ts.refreshAt = time.Time{}
+	ts.mu.Unlock()
+}
+
+// return an interceptor setting the bearer token on every request, the
+// cached token is dropped when a response is 401 Unauthorized
+func (ts *OAuth2TokenSource) Interceptor() Interceptor {
+	bearer := BearerTokenInterceptor(ts.Token)
+	return func(next http.RoundTripper) http.RoundTripper {
+		authorized := bearer(next)
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			response, err := authorized.RoundTrip(r)
+			if nil == err && http.StatusUnauthorized == response.StatusCode {
+				ts.Invalidate()
+			}
+			return response, err
+		})
+	}
+}
+
+// fetch a new token from the token endpoint and cache it, it runs detached
+// from the callers context as its result is shared by all of them
+func (ts *OAuth2TokenSource) refresh() (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTokenRequestTimeout)
+	defer cancel()
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(ts.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.cfg.Scopes, " "))
+	}
+	for key, value := range ts.cfg.EndpointParams {
+		form.Set(key, value)
+	}
+	if ts.cfg.CredentialsInBody {
+		form.Set("client_id", ts.cfg.ClientID)
+		form.Set("client_secret", ts.cfg.ClientSecret)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if nil != err {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if !ts.cfg.CredentialsInBody {
+		request.SetBasicAuth(url.QueryEscape(ts.cfg.ClientID), url.QueryEscape(ts.cfg.ClientSecret))
+	}
+
+	response, err := ts.client.Do(request)
+	if nil != err {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if nil != err {
+		return nil, err
+	}
+
+	if http.StatusOK != response.StatusCode {
+		oauthErr := &OAuth2Error{StatusCode: response.StatusCode}
+		json.Unmarshal(body, oauthErr)
+		return nil, oauthErr
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); nil != err || "" == tr.AccessToken {
+		return nil, ErrInvalidTokenResponse
+	}
+
+	// tokens without expires_in are kept until they get rejected with a 401
+	now := time.Now()
+	expiry := now.AddDate(100, 0, 0)
+	margin := ts.cfg.ExpiryMargin
+	if tr.ExpiresIn > 0 {
+		lifetime := time.Duration(tr.ExpiresIn) * time.Second
+		expiry = now.Add(lifetime)
+		// short lived tokens would be refreshed on every call otherwise
+		if margin > lifetime/2 {
+			margin = lifetime / 2
+		}
+	}
+
+	ts.mu.Lock()
+	ts.token = tr.AccessToken
+	ts.expiry = expiry
+	ts.refreshAt = expiry.Add(-margin)
+	ts.mu.Unlock()
+
+	return tr.AccessToken, nil
+}
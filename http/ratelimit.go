@@ -0,0 +1,182 @@
+package http
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("Rate Limit Exceeded")
+)
+
+// RateLimitMode defines what happens to a request exceeding the rate limit
+type RateLimitMode int
+
+const (
+	// wait for a token, unless the context expires before one is available
+	BlockOnRateLimit RateLimitMode = iota
+	// fail immediately with ErrRateLimited
+	FailOnRateLimit
+)
+
+// RateLimit is a token bucket refilled at QPS tokens per second,
+// Burst is the bucket size (0 means max(1, QPS))
+type RateLimit struct {
+	QPS   float64
+	Burst uint
+}
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64 // tokens per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	capacity := (float64)(limit.Burst)
+	if 0 == capacity {
+		capacity = math.Max(1, math.Ceil(limit.QPS))
+	}
+
+	return &tokenBucket{
+		rate:     limit.QPS,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+	}
+}
+
+// take a token and return how long to wait before using it, when the wait
+// would be longer than maxWait no token is taken and ok is false
+func (tb *tokenBucket) reserve(now time.Time, maxWait time.Duration) (wait time.Duration, ok bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.tokens = math.Min(tb.capacity, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+
+	if tb.tokens < 1 {
+		wait = time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+		if wait > maxWait {
+			return wait, false
+		}
+	}
+
+	tb.tokens--
+	return wait, true
+}
+
+// give back a token taken by reserve
+func (tb *tokenBucket) cancel() {
+	tb.mu.Lock()
+	tb.tokens = math.Min(tb.capacity, tb.tokens+1)
+	tb.mu.Unlock()
+}
+
+// rateLimiter holds the global bucket and one bucket per configured host
+type rateLimiter struct {
+	global *tokenBucket
+	hosts  map[string]*tokenBucket
+	mode   RateLimitMode
+}
+
+func newRateLimiter(cfg ClientConfig) *rateLimiter {
+	if 0 == len(cfg.HostRateLimits) && cfg.GlobalRateLimit.QPS <= 0 {
+		return nil
+	}
+
+	limiter := &rateLimiter{
+		hosts: make(map[string]*tokenBucket),
+		mode:  cfg.RateLimitMode,
+	}
+	if cfg.GlobalRateLimit.QPS > 0 {
+		limiter.global = newTokenBucket(cfg.GlobalRateLimit)
+	}
+	for host, limit := range cfg.HostRateLimits {
+		if limit.QPS > 0 {
+			limiter.hosts[host] = newTokenBucket(limit)
+		}
+	}
+
+	return limiter
+}
+
+// return the bucket of the given request URL host, host:port entries take
+// precedence over the plain host name ones
+func (limiter *rateLimiter) bucket(r *http.Request) *tokenBucket {
+	if bucket, ok := limiter.hosts[r.URL.Host]; ok {
+		return bucket
+	}
+	return limiter.hosts[r.URL.Hostname()]
+}
+
+// rateLimitTransport delays or rejects requests exceeding the rate limits
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter *rateLimiter
+	metrics *Metrics
+}
+
+func (t *rateLimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	now := time.Now()
+	maxWait := time.Duration(0)
+	if BlockOnRateLimit == t.limiter.mode {
+		maxWait = time.Duration(math.MaxInt64)
+		if deadline, ok := r.Context().Deadline(); ok {
+			maxWait = deadline.Sub(now)
+		}
+	}
+
+	var wait time.Duration
+	reserved := make([]*tokenBucket, 0, 2)
+	for _, bucket := range []*tokenBucket{t.limiter.bucket(r), t.limiter.global} {
+		if nil == bucket {
+			continue
+		}
+
+		bucketWait, ok := bucket.reserve(now, maxWait)
+		if !ok {
+			for _, taken := range reserved {
+				taken.cancel()
+			}
+			atomic.AddUint64(&t.metrics.host(r.URL.Host).throttled, 1)
+			return nil, t.reject(r)
+		}
+		reserved = append(reserved, bucket)
+		if bucketWait > wait {
+			wait = bucketWait
+		}
+	}
+
+	if wait > 0 {
+		atomic.AddUint64(&t.metrics.host(r.URL.Host).delayed, 1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			for _, taken := range reserved {
+				taken.cancel()
+			}
+			if nil != r.Body {
+				r.Body.Close()
+			}
+			return nil, r.Context().Err()
+		}
+	}
+
+	return t.next.RoundTrip(r)
+}
+
+func (t *rateLimitTransport) reject(r *http.Request) error {
+	if nil != r.Body {
+		r.Body.Close()
+	}
+	return ErrRateLimited
+}
@@ -0,0 +1,258 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrFixtureNotFound = errors.New("Fixture Not Found")
+)
+
+// RecorderMode selects whether a Recorder captures or serves interactions
+type RecorderMode int
+
+const (
+	// send requests upstream and save every interaction to FixtureDir
+	RecordMode RecorderMode = iota
+	// serve interactions from FixtureDir without any network access
+	ReplayMode
+)
+
+// FaultType is a failure injected by a Recorder instead of the response
+type FaultType int
+
+const (
+	NoFault FaultType = iota
+	// block until the request context is done
+	TimeoutFault
+	// answer with 503 Service Unavailable
+	ServerErrorFault
+	// fail with a connection reset error
+	ConnectionResetFault
+)
+
+type RecorderConfig struct {
+	Mode       RecorderMode
+	FixtureDir string
+	// request headers taken into account, along with the method, the URL and
+	// the body, to match a request with its fixture
+	MatchHeaders []string
+	// delay added before every response
+	Latency time.Duration
+	// probability (0 to 1) of injecting FaultType instead of the response
+	FaultRate float64
+	FaultType FaultType
+	// decide the fault of each request, overrides FaultRate when set
+	FaultFunc func(r *http.Request) FaultType
+}
+
+// Recorder is an interceptor recording real interactions to fixture files
+// and replaying them in tests
+//
+//	recorder := http.NewRecorder(http.RecorderConfig{Mode: http.ReplayMode, FixtureDir: "testdata"})
+//	client, _ := http.NewHTTPClient(http.ClientConfig{
+//		MaxHTTPClient: 1,
+//		Interceptors:  []http.Interceptor{recorder.Interceptor()},
+//	})
+type Recorder struct {
+	cfg RecorderConfig
+}
+
+type fixtureRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+}
+
+type fixtureResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+type fixture struct {
+	Request  fixtureRequest  `json:"request"`
+	Response fixtureResponse `json:"response"`
+}
+
+func NewRecorder(cfg RecorderConfig) *Recorder {
+	return &Recorder{cfg: cfg}
+}
+
+func (rec *Recorder) Interceptor() Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return rec.roundTrip(next, r)
+		})
+	}
+}
+
+func (rec *Recorder) roundTrip(next http.RoundTripper, r *http.Request) (*http.Response, error) {
+	var body []byte
+	if nil != r.Body {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if nil != err {
+			return nil, err
+		}
+	}
+
+	if rec.cfg.Latency > 0 {
+		timer := time.NewTimer(rec.cfg.Latency)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		}
+	}
+
+	switch rec.fault(r) {
+	case TimeoutFault:
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	case ServerErrorFault:
+		return rec.response(r, fixtureResponse{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       []byte(http.StatusText(http.StatusServiceUnavailable)),
+		}), nil
+	case ConnectionResetFault:
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+
+	fixtureFile := filepath.Join(rec.cfg.FixtureDir, rec.fixtureName(r, body))
+	if ReplayMode == rec.cfg.Mode {
+		data, err := ioutil.ReadFile(fixtureFile)
+		if nil != err {
+			return nil, fmt.Errorf("%w: %s %s", ErrFixtureNotFound, r.Method, r.URL)
+		}
+
+		var fx fixture
+		if err := json.Unmarshal(data, &fx); nil != err {
+			return nil, err
+		}
+		return rec.response(r, fx.Response), nil
+	}
+
+	upstream := r.Clone(r.Context())
+	if nil != body {
+		upstream.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	response, err := next.RoundTrip(upstream)
+	if nil != err {
+		return nil, err
+	}
+
+	respBody, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if nil != err {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	fx := fixture{
+		Request: fixtureRequest{
+			Method:  r.Method,
+			URL:     r.URL.String(),
+			Headers: rec.matchedHeaders(r),
+			Body:    body,
+		},
+		Response: fixtureResponse{
+			StatusCode: response.StatusCode,
+			Headers:    response.Header,
+			Body:       respBody,
+		},
+	}
+	data, err := json.MarshalIndent(fx, "", "  ")
+	if nil != err {
+		return nil, err
+	}
+	if err := os.MkdirAll(rec.cfg.FixtureDir, 0755); nil != err {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fixtureFile, data, 0644); nil != err {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (rec *Recorder) fault(r *http.Request) FaultType {
+	if nil != rec.cfg.FaultFunc {
+		return rec.cfg.FaultFunc(r)
+	}
+	if rec.cfg.FaultRate > 0 && rand.Float64() < rec.cfg.FaultRate {
+		return rec.cfg.FaultType
+	}
+	return NoFault
+}
+
+func (rec *Recorder) matchedHeaders(r *http.Request) http.Header {
+	if 0 == len(rec.cfg.MatchHeaders) {
+		return nil
+	}
+
+	headers := http.Header{}
+	for _, key := range rec.cfg.MatchHeaders {
+		if values := r.Header.Values(key); len(values) > 0 {
+			headers[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+	return headers
+}
+
+// return the fixture file name of a request, derived from everything used
+// to match it
+func (rec *Recorder) fixtureName(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.String())
+
+	headers := rec.matchedHeaders(r)
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s: %s\n", key, strings.Join(headers[key], ","))
+	}
+	hash.Write(body)
+
+	return strings.ToLower(r.Method) + "_" + hex.EncodeToString(hash.Sum(nil))[:16] + ".json"
+}
+
+func (rec *Recorder) response(r *http.Request, fr fixtureResponse) *http.Response {
+	headers := fr.Headers
+	if nil == headers {
+		headers = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fr.StatusCode, http.StatusText(fr.StatusCode)),
+		StatusCode:    fr.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        headers.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(fr.Body)),
+		ContentLength: int64(len(fr.Body)),
+		Request:       r,
+	}
+}
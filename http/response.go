@@ -0,0 +1,186 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+var (
+	ErrNilResponse         = errors.New("http.Response is null")
+	ErrResponseTooLarge    = errors.New("Response Body Too Large")
+	ErrUnexpectedStatus    = errors.New("Unexpected Response Status")
+	ErrUnsupportedEncoding = errors.New("Unsupported Content-Encoding")
+	ErrBodyDecoded         = errors.New("Response Body Already Decoded")
+)
+
+// return nil if the response status code is one of the expected codes,
+// otherwise an error wrapping ErrUnexpectedStatus
+func (req *HTTPRequest) ExpectStatus(codes ...int) error {
+	if nil == req.response {
+		return ErrNilResponse
+	}
+
+	for _, code := range codes {
+		if code == req.response.StatusCode {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %d", ErrUnexpectedStatus, req.response.StatusCode)
+}
+
+// read the response body decompressing it according to its Content-Encoding.
+// if maxBytes is greater than 0 and the decoded body is larger than maxBytes,
+// ErrResponseTooLarge is returned.
+// as for GetResponseBody the returned slice is only valid until Close
+func (req *HTTPRequest) ReadResponseBody(maxBytes int64) ([]byte, error) {
+	if nil == req.response {
+		return nil, ErrNilResponse
+	}
+
+	if nil == req.decodedBody {
+		identity := isIdentityEncoding(req.response.Header.Get("Content-Encoding"))
+		if identity && nil != req.body {
+			// already read by GetResponseBody, there is nothing to decode
+			req.decodedBody = req.body
+		} else {
+			reader, err := req.responseReader(maxBytes)
+			if nil != err {
+				return nil, err
+			}
+			defer reader.Close()
+
+			sizeHint := int64(-1)
+			if identity {
+				sizeHint = req.response.ContentLength
+			}
+			buff, err := req.readBody(reader, sizeHint)
+			if nil != err {
+				return nil, err
+			}
+			req.decodedBody = buff
+		}
+	}
+
+	if maxBytes > 0 && int64(req.decodedBody.Len()) > maxBytes {
+		return nil, ErrResponseTooLarge
+	}
+	return req.decodedBody.Bytes(), nil
+}
+
+// decode the JSON response body of req into a value of type T, the body is
+// decompressed and size limited the same way as in ReadResponseBody
+func DecodeJSON[T any](req *HTTPRequest, maxBytes int64) (T, error) {
+	var value T
+	reader, err := req.responseReader(maxBytes)
+	if nil != err {
+		return value, err
+	}
+	defer reader.Close()
+
+	startTime := time.Now()
+	err = json.NewDecoder(reader).Decode(&value)
+	req.timings.BodyRead = time.Since(startTime)
+	return value, err
+}
+
+// return a reader over the decoded response body. the body already read by
+// ReadResponseBody is read from its buffer as is, the one read by
+// GetResponseBody is decoded from its buffer
+func (req *HTTPRequest) responseReader(maxBytes int64) (io.ReadCloser, error) {
+	if nil == req.response {
+		return nil, ErrNilResponse
+	}
+
+	var reader io.ReadCloser
+	if nil != req.decodedBody {
+		reader = ioutil.NopCloser(bytes.NewReader(req.decodedBody.Bytes()))
+	} else {
+		var body io.Reader = req.response.Body
+		if nil != req.body {
+			body = bytes.NewReader(req.body.Bytes())
+		}
+		var err error
+		if reader, err = decodeContent(req.response.Header.Get("Content-Encoding"), body); nil != err {
+			return nil, err
+		}
+	}
+
+	if maxBytes > 0 {
+		reader = &limitedReader{ReadCloser: reader, remaining: maxBytes}
+	}
+
+	return reader, nil
+}
+
+func isIdentityEncoding(encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	return "" == encoding || "identity" == encoding
+}
+
+// wrap body into a decompressing reader for the given Content-Encoding
+func decodeContent(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(body), nil
+
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+
+	case "deflate":
+		// deflate is supposed to be zlib wrapped but some servers send the
+		// raw stream, so sniff the zlib header before choosing the reader
+		buffered := bufio.NewReader(body)
+		header, err := buffered.Peek(2)
+		if nil != err {
+			return nil, err
+		}
+		if 8 == header[0]&0x0f && 0 == (uint16(header[0])<<8|uint16(header[1]))%31 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(body)), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
+
+// limitedReader fails with ErrResponseTooLarge instead of silently
+// truncating the body like io.LimitedReader does
+type limitedReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+
+	// allow reading one byte past the limit to detect oversized bodies
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+
+	n, err := lr.ReadCloser.Read(p)
+	lr.remaining -= int64(n)
+	if lr.remaining < 0 {
+		return n + int(lr.remaining), ErrResponseTooLarge
+	}
+
+	return n, err
+}
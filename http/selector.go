@@ -0,0 +1,87 @@
+package http
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+)
+
+// ClientSelection is the strategy used by HTTPClient to pick one of its
+// pooled http.Clients
+type ClientSelection int
+
+const (
+	// rotate over the pooled clients
+	RoundRobinSelection ClientSelection = iota
+	// pick the client with the fewest requests in flight
+	LeastOutstandingSelection
+	// pick the least loaded of two randomly chosen clients
+	PowerOfTwoChoicesSelection
+)
+
+// return the index of the pooled client to use according to the configured
+// selection strategy
+func (client *HTTPClient) selectIndex() int {
+	count := len(client.clients)
+
+	switch client.selection {
+	case LeastOutstandingSelection:
+		// start from a rotating offset so ties do not always favour client 0
+		start := (int)(atomic.AddUint64(&client.clientIndex, 1) % client.clientCount)
+		best := start
+		bestInflight := atomic.LoadInt64(&client.inflight[start])
+		for offset := 1; offset < count && bestInflight > 0; offset++ {
+			idx := (start + offset) % count
+			if inflight := atomic.LoadInt64(&client.inflight[idx]); inflight < bestInflight {
+				best, bestInflight = idx, inflight
+			}
+		}
+		return best
+
+	case PowerOfTwoChoicesSelection:
+		if count < 2 {
+			return 0
+		}
+		first := rand.Intn(count)
+		second := rand.Intn(count - 1)
+		if second >= first {
+			second++
+		}
+		if atomic.LoadInt64(&client.inflight[second]) < atomic.LoadInt64(&client.inflight[first]) {
+			return second
+		}
+		return first
+	}
+
+	index := atomic.AddUint64(&client.clientIndex, 1) - 1
+	return (int)(index % client.clientCount)
+}
+
+// return a pooled client along with the function to call once the request
+// sent through it has completed, the request is counted as in flight on that
+// client until then
+func (client *HTTPClient) AcquireClient() (*http.Client, func()) {
+	idx := client.acquire()
+	return client.clients[idx], func() {
+		client.release(idx)
+	}
+}
+
+func (client *HTTPClient) acquire() int {
+	idx := client.selectIndex()
+	atomic.AddInt64(&client.inflight[idx], 1)
+	return idx
+}
+
+func (client *HTTPClient) release(idx int) {
+	atomic.AddInt64(&client.inflight[idx], -1)
+}
+
+// return the number of requests in flight on each pooled client
+func (client *HTTPClient) Inflight() []int64 {
+	inflight := make([]int64, len(client.inflight))
+	for idx := range client.inflight {
+		inflight[idx] = atomic.LoadInt64(&client.inflight[idx])
+	}
+	return inflight
+}
@@ -0,0 +1,367 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSSERetry = 3 * time.Second
+)
+
+// watch ctx and close body as soon as it is done so that a blocked read
+// returns, the returned function stops watching
+func closeOnDone(ctx context.Context, body io.Closer) func() {
+	stopChan := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			body.Close()
+		case <-stopChan:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stopChan) })
+	}
+}
+
+// NDJSONReader iterates over a newline delimited JSON response, decoding
+// every line into a value of type T
+//
+//	reader, err := http.NewNDJSONReader[Bid](ctx, req)
+//	if nil != err {
+//		return err
+//	}
+//	defer reader.Close()
+//	for reader.Next() {
+//		bid := reader.Value()
+//	}
+//	err = reader.Err()
+type NDJSONReader[T any] struct {
+	ctx      context.Context
+	body     io.ReadCloser
+	response io.Closer
+	reader   *bufio.Reader
+	stop     func()
+	value    T
+	err      error
+}
+
+// return a reader over the response of an executed request, reading stops
+// with ctx error as soon as ctx is done
+func NewNDJSONReader[T any](ctx context.Context, req *HTTPRequest) (*NDJSONReader[T], error) {
+	body, err := req.responseReader(0)
+	if nil != err {
+		return nil, err
+	}
+
+	return &NDJSONReader[T]{
+		ctx:      ctx,
+		body:     body,
+		response: req.response.Body,
+		reader:   bufio.NewReader(body),
+		stop:     closeOnDone(ctx, req.response.Body),
+	}, nil
+}
+
+// decode the next line, return false at the end of the stream or on error
+func (r *NDJSONReader[T]) Next() bool {
+	if nil != r.err {
+		return false
+	}
+
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if nil != r.ctx.Err() {
+			r.finish(r.ctx.Err())
+			return false
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			var value T
+			if jsonErr := json.Unmarshal(line, &value); nil != jsonErr {
+				r.finish(jsonErr)
+				return false
+			}
+			r.value = value
+			if nil != err && io.EOF != err {
+				// the value is complete, report the error on the next call
+				r.err = err
+			}
+			return true
+		}
+
+		if nil != err {
+			r.finish(err)
+			return false
+		}
+	}
+}
+
+// return the value decoded by the last call to Next
+func (r *NDJSONReader[T]) Value() T {
+	return r.value
+}
+
+// return the error which stopped the iteration, nil at the end of the stream
+func (r *NDJSONReader[T]) Err() error {
+	if io.EOF == r.err {
+		return nil
+	}
+	return r.err
+}
+
+// stop reading and release the response body, Next returns false afterwards.
+// it must be called when the iteration stops before the end of the stream
+func (r *NDJSONReader[T]) Close() {
+	if nil == r.err {
+		r.err = io.EOF
+	}
+	r.stop()
+	r.body.Close()
+	r.response.Close()
+}
+
+func (r *NDJSONReader[T]) finish(err error) {
+	r.err = err
+	r.stop()
+	r.body.Close()
+}
+
+// SSEEvent is a single Server-Sent Event
+type SSEEvent struct {
+	ID    string
+	Event string // "message" when not set by the server
+	Data  string
+	Retry time.Duration
+}
+
+// SSEReader parses a Server-Sent Events stream, reconnecting with the
+// Last-Event-ID header whenever the connection drops until ctx is done
+//
+//	reader := http.NewSSEReader(ctx, client, req)
+//	defer reader.Close()
+//	for reader.Next() {
+//		event := reader.Event()
+//	}
+//	err = reader.Err()
+type SSEReader struct {
+	ctx         context.Context
+	client      *HTTPClient
+	request     *http.Request
+	response    *http.Response
+	reader      *bufio.Reader
+	stop        func()
+	event       SSEEvent
+	lastEventID string
+	retry       time.Duration
+	err         error
+}
+
+// return a reader over the event stream of req, if req was already executed
+// its response is consumed first, otherwise the request is sent through client
+func NewSSEReader(ctx context.Context, client *HTTPClient, req *HTTPRequest) *SSEReader {
+	r := &SSEReader{
+		ctx:     ctx,
+		client:  client,
+		request: req.request,
+		retry:   defaultSSERetry,
+	}
+
+	if nil != req.response {
+		r.attach(req.response)
+	}
+
+	return r
+}
+
+// return the last event read by Next
+func (r *SSEReader) Event() SSEEvent {
+	return r.event
+}
+
+// return the id of the last event received
+func (r *SSEReader) LastEventID() string {
+	return r.lastEventID
+}
+
+// return the error which stopped the stream, nil if ctx was cancelled
+func (r *SSEReader) Err() error {
+	if errors.Is(r.err, context.Canceled) {
+		return nil
+	}
+	return r.err
+}
+
+func (r *SSEReader) Close() {
+	r.detach()
+}
+
+func (r *SSEReader) attach(response *http.Response) {
+	r.response = response
+	r.reader = bufio.NewReader(response.Body)
+	r.stop = closeOnDone(r.ctx, response.Body)
+}
+
+func (r *SSEReader) detach() {
+	if nil != r.response {
+		r.stop()
+		r.response.Body.Close()
+		r.response = nil
+	}
+}
+
+// (re)connect to the stream, a non retryable error is returned when the
+// server answers with something else than an event stream
+func (r *SSEReader) connect() (retryable bool, err error) {
+	request := r.request.Clone(r.ctx)
+	if nil != r.request.GetBody {
+		if request.Body, err = r.request.GetBody(); nil != err {
+			return false, err
+		}
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	if "" != r.lastEventID {
+		request.Header.Set("Last-Event-ID", r.lastEventID)
+	}
+
+	httpClient, release := r.client.AcquireClient()
+	response, err := httpClient.Do(request)
+	release()
+	if nil != err {
+		return true, err
+	}
+
+	if http.StatusOK != response.StatusCode ||
+		!strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream") {
+		response.Body.Close()
+		if http.StatusNoContent == response.StatusCode {
+			// the server asks the client to stop reconnecting
+			return false, io.EOF
+		}
+		return false, ErrUnexpectedStatus
+	}
+
+	r.attach(response)
+	return false, nil
+}
+
+// read the next event, reconnecting if needed. return false once ctx is done
+// or the server refuses the stream
+func (r *SSEReader) Next() bool {
+	for nil == r.err {
+		if nil == r.response {
+			retryable, err := r.connect()
+			if nil != err {
+				if !retryable || !r.wait() {
+					r.fail(err)
+				}
+				continue
+			}
+		}
+
+		if r.readEvent() {
+			return true
+		}
+
+		// the connection dropped, reconnect after the retry delay
+		r.detach()
+		if !r.wait() {
+			r.fail(r.ctx.Err())
+		}
+	}
+
+	return false
+}
+
+func (r *SSEReader) fail(err error) {
+	if nil != r.ctx.Err() {
+		err = r.ctx.Err()
+	}
+	r.err = err
+	r.detach()
+}
+
+// sleep for the retry delay, return false if ctx is done meanwhile
+func (r *SSEReader) wait() bool {
+	timer := time.NewTimer(r.retry)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// parse lines until an event is dispatched, return false if the
+// connection ends first
+func (r *SSEReader) readEvent() bool {
+	var data strings.Builder
+	hasData := false
+	event := SSEEvent{}
+
+	for {
+		line, err := r.reader.ReadString('\n')
+		if nil != err {
+			// an incomplete event at the end of the stream is discarded
+			return false
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if "" == line {
+			if !hasData {
+				event = SSEEvent{}
+				continue
+			}
+
+			event.ID = r.lastEventID
+			event.Data = strings.TrimSuffix(data.String(), "\n")
+			if "" == event.Event {
+				event.Event = "message"
+			}
+			r.event = event
+			return true
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if idx := strings.IndexByte(line, ':'); idx >= 0 {
+			field, value = line[:idx], strings.TrimPrefix(line[idx+1:], " ")
+		}
+
+		switch field {
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "event":
+			event.Event = value
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				r.lastEventID = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); nil == err {
+				r.retry = time.Duration(ms) * time.Millisecond
+				event.Retry = r.retry
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrInvalidCACert     = errors.New("No valid certificate found in CA bundle")
+	ErrConflictingHTTP2  = errors.New("ForceHTTP2 and DisableHTTP2 are mutually exclusive")
+	ErrIncompleteKeyPair = errors.New("ClientCertFile and ClientKeyFile must be set together")
+)
+
+// create the http.Transport of a pooled client from the given config
+func newTransport(
+	cfg ClientConfig,
+	tlsConfig *tls.Config,
+	proxy func(*http.Request) (*url.URL, error),
+	dns *dnsCache) *http.Transport {
+	tlsHandshakeTimeout := (time.Duration)(cfg.TLSHandshakeTimeoutMS) * time.Millisecond
+	if 0 == tlsHandshakeTimeout {
+		tlsHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   (time.Duration)(cfg.ConnectionTimeoutMS) * time.Millisecond,
+		KeepAlive: (time.Duration)(cfg.KeepAliveSec) * time.Second,
+	}
+
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		Proxy:               proxy,
+		TLSClientConfig:     tlsConfig,
+		DisableKeepAlives:   false,
+		IdleConnTimeout:     time.Duration(cfg.IdleConnTimeoutSec) * time.Second,
+		MaxIdleConnsPerHost: (int)(cfg.MaxIdleConnsPerHost / (uint)(cfg.MaxHTTPClient)),
+		MaxConnsPerHost:     (int)(cfg.MaxConnsPerHost / (uint)(cfg.MaxHTTPClient)),
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		// a custom dialer or TLS config disables HTTP/2 unless forced
+		ForceAttemptHTTP2: cfg.ForceHTTP2,
+	}
+
+	if nil != dns {
+		transport.DialContext = dns.dialContext(dialer)
+	}
+
+	if cfg.DisableHTTP2 {
+		// a non-nil empty map prevents the transport from upgrading to HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return transport
+}
+
+// build the TLS config shared by all pooled transports,
+// nil is returned when no TLS option is set
+func newTLSConfig(cfg ClientConfig) (*tls.Config, error) {
+	if "" == cfg.CACertFile && "" == cfg.ClientCertFile && "" == cfg.ClientKeyFile &&
+		0 == cfg.MinTLSVersion && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         cfg.MinTLSVersion,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if "" != cfg.CACertFile {
+		pem, err := ioutil.ReadFile(cfg.CACertFile)
+		if nil != err {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if nil != err {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCACert
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if "" != cfg.ClientCertFile || "" != cfg.ClientKeyFile {
+		if "" == cfg.ClientCertFile || "" == cfg.ClientKeyFile {
+			return nil, ErrIncompleteKeyPair
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if nil != err {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// build the proxy selector of the transports,
+// nil (no proxy) is returned when ProxyURL is empty
+func newProxyFunc(cfg ClientConfig) (func(*http.Request) (*url.URL, error), error) {
+	if "" == cfg.ProxyURL {
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(cfg.ProxyURL)
+	if nil != err {
+		return nil, err
+	}
+
+	return func(r *http.Request) (*url.URL, error) {
+		if matchNoProxy(r.URL.Hostname(), cfg.NoProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// return true if host matches one of the no-proxy entries.
+// an entry is either "*", an IP address, a CIDR range or a domain name,
+// a domain matches itself and all of its subdomains
+func matchNoProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if "" == entry {
+			continue
+		}
+		if "*" == entry {
+			return true
+		}
+
+		if nil != ip {
+			if _, cidr, err := net.ParseCIDR(entry); nil == err {
+				if cidr.Contains(ip) {
+					return true
+				}
+				continue
+			}
+			if entryIP := net.ParseIP(entry); nil != entryIP && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,300 @@
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// placeholders limit of a prepared statement
+	maxStatementParams = 65535
+	// room left in the packet for the protocol headers
+	packetOverhead = 1024
+)
+
+var (
+	ErrColumnCount     = errors.New("Row Values Do Not Match The Columns")
+	ErrUnmappedColumn  = errors.New("Column Not Mapped To A Struct Field")
+	ErrNotStruct       = errors.New("Value Is Not A Struct")
+	ErrRowTooLarge     = errors.New("Row Exceeds MaxAllowedPacket")
+	ErrNoInsertColumns = errors.New("No Column To Insert")
+)
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// BulkInsert builds multi-row INSERT statements and splits the rows into as
+// many statements as needed to keep every one of them under MaxAllowedPacket
+//
+//	affected, err := conn.NewBulkInsert("campaign_stats", "id", "clicks").
+//		OnDuplicateKeyUpdate("clicks").
+//		AddRow(1, 10).
+//		AddRow(2, 20).
+//		Exec(ctx)
+type BulkInsert struct {
+	exec          execer
+	maxPacket     int
+	table         string
+	columns       []string
+	ignore        bool
+	updateColumns []string
+	rows          [][]any
+	rowSizes      []int
+	err           error
+}
+
+// return a bulk insert of the given columns into table
+func (conn *MysqlConnector) NewBulkInsert(table string, columns ...string) *BulkInsert {
+	return newBulkInsert(conn, conn.maxAllowedPacket, table, columns)
+}
+
+// return a bulk insert running in the transaction
+func (tx *Tx) NewBulkInsert(table string, columns ...string) *BulkInsert {
+	return newBulkInsert(tx, tx.maxAllowedPacket, table, columns)
+}
+
+func newBulkInsert(exec execer, maxPacket int, table string, columns []string) *BulkInsert {
+	b := &BulkInsert{
+		exec:      exec,
+		maxPacket: maxPacket,
+		table:     table,
+		columns:   columns,
+		rows:      make([][]any, 0),
+		rowSizes:  make([]int, 0),
+	}
+	if 0 == len(columns) {
+		b.err = ErrNoInsertColumns
+	}
+	return b
+}
+
+// skip the rows conflicting with an existing unique key (INSERT IGNORE)
+func (b *BulkInsert) Ignore() *BulkInsert {
+	b.ignore = true
+	return b
+}
+
+// update the given columns of the existing rows on unique key conflicts
+func (b *BulkInsert) OnDuplicateKeyUpdate(columns ...string) *BulkInsert {
+	b.updateColumns = columns
+	return b
+}
+
+// add a row, its values are in the order of the columns
+func (b *BulkInsert) AddRow(values ...any) *BulkInsert {
+	if nil != b.err {
+		return b
+	}
+	if len(values) != len(b.columns) {
+		b.err = ErrColumnCount
+		return b
+	}
+
+	size := 3 // "()," in the statement
+	for _, value := range values {
+		size += paramSize(value)
+	}
+	if statementOverhead := len(b.prefix()) + len(b.suffix()) + packetOverhead; size+statementOverhead > b.maxPacket {
+		b.err = ErrRowTooLarge
+		return b
+	}
+
+	b.rows = append(b.rows, values)
+	b.rowSizes = append(b.rowSizes, size)
+	return b
+}
+
+// add a row from the fields of a struct (or a pointer to a struct) mapped to
+// the columns by their `db` tag or name, see QueryInto
+func (b *BulkInsert) AddStruct(value any) *BulkInsert {
+	if nil != b.err {
+		return b
+	}
+
+	v := reflect.ValueOf(value)
+	for reflect.Ptr == v.Kind() && !v.IsNil() {
+		v = v.Elem()
+	}
+	if reflect.Struct != v.Kind() {
+		b.err = ErrNotStruct
+		return b
+	}
+
+	fields := structFields(v.Type())
+	values := make([]any, len(b.columns))
+	for idx, column := range b.columns {
+		path, ok := fields[strings.ToLower(column)]
+		if !ok {
+			b.err = fmt.Errorf("%w: %s", ErrUnmappedColumn, column)
+			return b
+		}
+		values[idx] = fieldValue(v, path)
+	}
+
+	return b.AddRow(values...)
+}
+
+// insert the rows, one statement per chunk, and return the rows affected by
+// every chunk. with ON DUPLICATE KEY UPDATE an updated row counts as 2.
+// on error the rows affected by the chunks already inserted are returned
+func (b *BulkInsert) Exec(ctx context.Context) ([]int64, error) {
+	if nil != b.err {
+		return nil, b.err
+	}
+
+	affected := make([]int64, 0)
+	prefix, suffix := b.prefix(), b.suffix()
+	maxRows := maxStatementParams / len(b.columns)
+
+	for start := 0; start < len(b.rows); {
+		size := len(prefix) + len(suffix) + packetOverhead
+		end := start
+		for end < len(b.rows) && end-start < maxRows && size+b.rowSizes[end] <= b.maxPacket {
+			size += b.rowSizes[end]
+			end++
+		}
+
+		query, args := b.statement(prefix, suffix, b.rows[start:end])
+		result, err := b.exec.ExecContext(ctx, query, args...)
+		if nil != err {
+			return affected, err
+		}
+		count, err := result.RowsAffected()
+		if nil != err {
+			return affected, err
+		}
+		affected = append(affected, count)
+
+		start = end
+	}
+
+	return affected, nil
+}
+
+// return the INSERT statement of the rows and its arguments
+func (b *BulkInsert) statement(prefix, suffix string, rows [][]any) (string, []any) {
+	rowPlaceholders := "(" + strings.Repeat("?,", len(b.columns)-1) + "?)"
+	args := make([]any, 0, len(rows)*len(b.columns))
+
+	var buff bytes.Buffer
+	buff.WriteString(prefix)
+	for idx, row := range rows {
+		if idx > 0 {
+			buff.WriteString(",")
+		}
+		buff.WriteString(rowPlaceholders)
+		args = append(args, row...)
+	}
+	buff.WriteString(suffix)
+
+	return buff.String(), args
+}
+
+func (b *BulkInsert) prefix() string {
+	var buff bytes.Buffer
+	buff.WriteString("INSERT ")
+	if b.ignore {
+		buff.WriteString("IGNORE ")
+	}
+	buff.WriteString("INTO ")
+	buff.WriteString(quoteIdentifier(b.table))
+	buff.WriteString(" (")
+	for idx, column := range b.columns {
+		if idx > 0 {
+			buff.WriteString(",")
+		}
+		buff.WriteString(quoteIdentifier(column))
+	}
+	buff.WriteString(") VALUES ")
+	return buff.String()
+}
+
+func (b *BulkInsert) suffix() string {
+	if 0 == len(b.updateColumns) {
+		return ""
+	}
+
+	var buff bytes.Buffer
+	buff.WriteString(" ON DUPLICATE KEY UPDATE ")
+	for idx, column := range b.updateColumns {
+		if idx > 0 {
+			buff.WriteString(",")
+		}
+		quoted := quoteIdentifier(column)
+		buff.WriteString(quoted)
+		buff.WriteString("=VALUES(")
+		buff.WriteString(quoted)
+		buff.WriteString(")")
+	}
+	return buff.String()
+}
+
+// quote a table or column name, "db.table" is quoted as `db`.`table`
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for idx, part := range parts {
+		parts[idx] = "`" + strings.ReplaceAll(part, "`", "``") + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// return the approximate size of the value in the statement packet
+func paramSize(value any) int {
+	// "?," in the statement and the parameter type
+	const paramOverhead = 4
+
+	// the driver dereferences the pointers, e.g. the nullable fields mapped
+	// by AddStruct
+	if _, ok := value.(driver.Valuer); !ok {
+		if v := reflect.ValueOf(value); reflect.Ptr == v.Kind() {
+			for reflect.Ptr == v.Kind() && !v.IsNil() {
+				v = v.Elem()
+			}
+			value = nil
+			if reflect.Ptr != v.Kind() {
+				value = v.Interface()
+			}
+		}
+	}
+
+	if valuer, ok := value.(driver.Valuer); ok {
+		if v, err := valuer.Value(); nil == err {
+			value = v
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return paramOverhead
+	case string:
+		return paramOverhead + len(v) + 9
+	case []byte:
+		return paramOverhead + len(v) + 9
+	case time.Time:
+		return paramOverhead + 12
+	}
+	return paramOverhead + 8
+}
+
+// return the value of the field at the index path, nil when it is in a nil
+// embedded struct
+func fieldValue(v reflect.Value, index []int) any {
+	for _, idx := range index {
+		if reflect.Ptr == v.Kind() {
+			if v.IsNil() {
+				return nil
+			}
+			v = v.Elem()
+		}
+		v = v.Field(idx)
+	}
+	return v.Interface()
+}
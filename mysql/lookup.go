@@ -0,0 +1,194 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoLookupKey = errors.New("Lookup Table Key Not Set")
+)
+
+type LookupTableConfig[K comparable, V any] struct {
+	// query loading the rows, mapped to V as in QueryInto
+	Query string
+	Args  []any
+	// required, return the key of a row, the last row wins when keys collide
+	Key func(row V) K
+	// reload the rows on this interval, 0 disables the periodic reload
+	RefreshInterval time.Duration
+	// reload the rows when the watcher reports a change of one of Tables,
+	// or of any table it watches when Tables is empty
+	Watcher *TableWatcher
+	Tables  []string
+}
+
+// LookupTable is an in-memory copy of a small reference table (campaigns,
+// publishers...) indexed by key. reloads build a new copy which replaces the
+// current one atomically, readers never wait and a failed reload keeps the
+// last good copy
+type LookupTable[K comparable, V any] struct {
+	conn *MysqlConnector
+	cfg  LookupTableConfig[K, V]
+
+	snapshot  atomic.Value // *lookupSnapshot[K, V]
+	refreshMu sync.Mutex
+	errMu     sync.Mutex
+	lastErr   error
+
+	closed int32
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type lookupSnapshot[K comparable, V any] struct {
+	rows        map[K]V
+	refreshedAt time.Time
+}
+
+// load the table and start refreshing it, the first load must succeed
+func NewLookupTable[K comparable, V any](ctx context.Context, conn *MysqlConnector, cfg LookupTableConfig[K, V]) (*LookupTable[K, V], error) {
+	if nil == cfg.Key {
+		return nil, ErrNoLookupKey
+	}
+
+	table := &LookupTable[K, V]{
+		conn: conn,
+		cfg:  cfg,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if err := table.Refresh(ctx); nil != err {
+		return nil, err
+	}
+
+	if nil != cfg.Watcher {
+		cfg.Watcher.OnChange(table.onTablesChange)
+	}
+
+	if cfg.RefreshInterval > 0 {
+		go table.run()
+	} else {
+		close(table.done)
+	}
+
+	return table, nil
+}
+
+// return the row of the key
+func (table *LookupTable[K, V]) Get(key K) (V, bool) {
+	value, ok := table.current().rows[key]
+	return value, ok
+}
+
+// call fn on every row until it returns false
+func (table *LookupTable[K, V]) Range(fn func(key K, value V) bool) {
+	for key, value := range table.current().rows {
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+// return the number of rows of the current copy
+func (table *LookupTable[K, V]) Len() int {
+	return len(table.current().rows)
+}
+
+// return the time of the last successful load
+func (table *LookupTable[K, V]) LastRefresh() time.Time {
+	return table.current().refreshedAt
+}
+
+// return the error of the last load, nil if it succeeded
+func (table *LookupTable[K, V]) LastError() error {
+	table.errMu.Lock()
+	defer table.errMu.Unlock()
+	return table.lastErr
+}
+
+// reload the rows now, the current copy is kept on error
+func (table *LookupTable[K, V]) Refresh(ctx context.Context) error {
+	table.refreshMu.Lock()
+	defer table.refreshMu.Unlock()
+
+	rows, err := QueryInto[V](ctx, table.conn, table.cfg.Query, table.cfg.Args...)
+
+	table.errMu.Lock()
+	table.lastErr = err
+	table.errMu.Unlock()
+	if nil != err {
+		return err
+	}
+
+	indexed := make(map[K]V, len(rows))
+	for _, row := range rows {
+		indexed[table.cfg.Key(row)] = row
+	}
+	table.snapshot.Store(&lookupSnapshot[K, V]{rows: indexed, refreshedAt: time.Now()})
+
+	return nil
+}
+
+// stop refreshing the table, the current copy stays readable
+func (table *LookupTable[K, V]) Close() {
+	if atomic.CompareAndSwapInt32(&table.closed, 0, 1) {
+		close(table.stop)
+		<-table.done
+	}
+}
+
+func (table *LookupTable[K, V]) current() *lookupSnapshot[K, V] {
+	return table.snapshot.Load().(*lookupSnapshot[K, V])
+}
+
+func (table *LookupTable[K, V]) run() {
+	defer close(table.done)
+
+	ticker := time.NewTicker(table.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-table.stop:
+			return
+		case <-ticker.C:
+		}
+		table.refresh()
+	}
+}
+
+// the watcher callback, watchers cannot unregister callbacks so it does
+// nothing once the table is closed
+func (table *LookupTable[K, V]) onTablesChange(changed []string) {
+	if 1 == atomic.LoadInt32(&table.closed) {
+		return
+	}
+
+	if len(table.cfg.Tables) > 0 && !containsAny(changed, table.cfg.Tables) {
+		return
+	}
+	table.refresh()
+}
+
+func (table *LookupTable[K, V]) refresh() {
+	if err := table.Refresh(context.Background()); nil != err {
+		log.Println("Failed to refresh MySQL lookup table, keeping the last copy.", err.Error())
+	}
+}
+
+func containsAny(list []string, values []string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
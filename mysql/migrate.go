@@ -0,0 +1,459 @@
+package mysql
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	defaultMigrationTable       = "schema_migrations"
+	defaultMigrationLockTimeout = 60 * time.Second
+
+	errNoSuchTable = 1146 // ER_NO_SUCH_TABLE
+)
+
+var (
+	ErrChecksumMismatch      = errors.New("Applied Migration Checksum Changed")
+	ErrMigrationLocked       = errors.New("Migration Lock Not Acquired")
+	ErrDuplicateMigration    = errors.New("Duplicate Migration Version")
+	ErrUnknownMigration      = errors.New("Unknown Migration Version")
+	ErrMissingUpMigration    = errors.New("Up Migration Not Found")
+	ErrMissingDownMigration  = errors.New("Down Migration Not Found")
+	ErrUnterminatedStatement = errors.New("Unterminated Quote Or Comment In Migration")
+)
+
+var migrationFileNamePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type MigrationConfig struct {
+	// files named <version>_<name>.up.sql and <version>_<name>.down.sql,
+	// e.g. an embed.FS or os.DirFS(dir)
+	FS fs.FS
+	// directory of the files within FS, "." by default
+	Dir string
+	// table recording the applied migrations, created if missing,
+	// schema_migrations by default
+	Table string
+	// how long to wait for a concurrent runner to finish, 60 seconds by default
+	LockTimeout time.Duration
+	// log the statements instead of running them
+	DryRun bool
+}
+
+// Migration is a versioned schema change read from the up/down files
+type Migration struct {
+	Version  uint64
+	Name     string
+	Up       string
+	Down     string // empty when there is no down file
+	Checksum string // sha256 of Up
+}
+
+// AppliedMigration is a row of the tracking table
+type AppliedMigration struct {
+	Version   uint64    `db:"version"`
+	Name      string    `db:"name"`
+	Checksum  string    `db:"checksum"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+// Migrator applies the migrations of a directory to the primary.
+// concurrent runners are serialized with GET_LOCK and every run first checks
+// that the applied migrations were not modified since they were applied.
+// a migration file may hold several statements separated by ';', as DDL
+// statements commit implicitly a failed migration may be partially applied
+type Migrator struct {
+	conn       *MysqlConnector
+	cfg        MigrationConfig
+	migrations []Migration // sorted by version
+}
+
+// return a migrator of the migrations found in cfg.FS
+func (conn *MysqlConnector) NewMigrator(cfg MigrationConfig) (*Migrator, error) {
+	if "" == cfg.Dir {
+		cfg.Dir = "."
+	}
+	if "" == cfg.Table {
+		cfg.Table = defaultMigrationTable
+	}
+	if 0 == cfg.LockTimeout {
+		cfg.LockTimeout = defaultMigrationLockTimeout
+	}
+
+	migrations, err := readMigrations(cfg.FS, cfg.Dir)
+	if nil != err {
+		return nil, err
+	}
+
+	return &Migrator{conn: conn, cfg: cfg, migrations: migrations}, nil
+}
+
+// return the migrations found in the directory
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// apply all pending migrations, the applied ones are returned
+func (m *Migrator) Migrate(ctx context.Context) ([]Migration, error) {
+	if 0 == len(m.migrations) {
+		return nil, nil
+	}
+	return m.MigrateTo(ctx, m.migrations[len(m.migrations)-1].Version)
+}
+
+// apply the pending migrations up to version, and revert the applied ones
+// above it. version 0 reverts all migrations.
+// the migrations applied or reverted, in order, are returned
+func (m *Migrator) MigrateTo(ctx context.Context, version uint64) ([]Migration, error) {
+	if 0 != version && nil == m.find(version) {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMigration, version)
+	}
+
+	c, err := m.conn.client.Conn(ctx)
+	if nil != err {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := m.lock(ctx, c); nil != err {
+		return nil, err
+	}
+	defer m.unlock(c)
+
+	applied, err := m.applied(ctx, c)
+	if nil != err {
+		return nil, err
+	}
+	if err := m.verify(applied); nil != err {
+		return nil, err
+	}
+
+	up, down, err := m.plan(applied, version)
+	if nil != err {
+		return nil, err
+	}
+
+	done := make([]Migration, 0, len(up)+len(down))
+	for _, migration := range down {
+		if err := m.revert(ctx, c, migration); nil != err {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	for _, migration := range up {
+		if err := m.apply(ctx, c, migration); nil != err {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// return the migrations recorded in the tracking table
+func (m *Migrator) Applied(ctx context.Context) ([]AppliedMigration, error) {
+	c, err := m.conn.client.Conn(ctx)
+	if nil != err {
+		return nil, err
+	}
+	defer c.Close()
+
+	applied, err := m.applied(ctx, c)
+	if nil != err {
+		return nil, err
+	}
+
+	list := make([]AppliedMigration, 0, len(applied))
+	for _, migration := range applied {
+		list = append(list, migration)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+
+	return list, nil
+}
+
+func (m *Migrator) find(version uint64) *Migration {
+	for idx := range m.migrations {
+		if version == m.migrations[idx].Version {
+			return &m.migrations[idx]
+		}
+	}
+	return nil
+}
+
+// serialize the runners, the lock is held by the session of c
+func (m *Migrator) lock(ctx context.Context, c *sql.Conn) error {
+	var acquired sql.NullInt64
+	err := c.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", m.lockName(), int64(m.cfg.LockTimeout/time.Second)).Scan(&acquired)
+	if nil != err {
+		return err
+	}
+	if !acquired.Valid || 1 != acquired.Int64 {
+		return ErrMigrationLocked
+	}
+	return nil
+}
+
+func (m *Migrator) unlock(c *sql.Conn) {
+	if _, err := c.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", m.lockName()); nil != err {
+		log.Println("Failed to release MySQL migration lock.", err.Error())
+	}
+}
+
+func (m *Migrator) lockName() string {
+	return "migrate:" + m.cfg.Table
+}
+
+// return the applied migrations by version, the tracking table is created
+// if missing unless running dry
+func (m *Migrator) applied(ctx context.Context, c *sql.Conn) (map[uint64]AppliedMigration, error) {
+	table := quoteIdentifier(m.cfg.Table)
+	if !m.cfg.DryRun {
+		_, err := c.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+" ("+
+			"version BIGINT UNSIGNED NOT NULL PRIMARY KEY, "+
+			"name VARCHAR(255) NOT NULL, "+
+			"checksum CHAR(64) NOT NULL, "+
+			"applied_at DATETIME NOT NULL)")
+		if nil != err {
+			return nil, err
+		}
+	}
+
+	applied := make(map[uint64]AppliedMigration)
+	list, err := QueryInto[AppliedMigration](ctx, &sessionQuerier{c: c, loc: m.conn.location},
+		"SELECT version, name, checksum, applied_at FROM "+table)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && errNoSuchTable == mysqlErr.Number && m.cfg.DryRun {
+		return applied, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	for _, migration := range list {
+		applied[migration.Version] = migration
+	}
+	return applied, nil
+}
+
+// refuse to run when an applied migration has been modified
+func (m *Migrator) verify(applied map[uint64]AppliedMigration) error {
+	for _, migration := range m.migrations {
+		if record, ok := applied[migration.Version]; ok && record.Checksum != migration.Checksum {
+			return fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
+
+// return the migrations to apply in ascending order and the ones to revert
+// in descending order to reach version
+func (m *Migrator) plan(applied map[uint64]AppliedMigration, version uint64) ([]Migration, []Migration, error) {
+	up := make([]Migration, 0)
+	down := make([]Migration, 0)
+
+	for _, migration := range m.migrations {
+		_, isApplied := applied[migration.Version]
+		if !isApplied && migration.Version <= version {
+			up = append(up, migration)
+		}
+	}
+
+	for idx := len(m.migrations) - 1; idx >= 0; idx-- {
+		migration := m.migrations[idx]
+		if _, isApplied := applied[migration.Version]; isApplied && migration.Version > version {
+			if "" == migration.Down {
+				return nil, nil, fmt.Errorf("%w: %d_%s", ErrMissingDownMigration, migration.Version, migration.Name)
+			}
+			down = append(down, migration)
+		}
+	}
+
+	return up, down, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, c *sql.Conn, migration Migration) error {
+	log.Println("Applying MySQL migration", migration.Version, migration.Name)
+	if err := m.run(ctx, c, migration.Up); nil != err {
+		return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+
+	return m.exec(ctx, c, "INSERT INTO "+quoteIdentifier(m.cfg.Table)+
+		" (version, name, checksum, applied_at) VALUES (?, ?, ?, NOW())",
+		migration.Version, migration.Name, migration.Checksum)
+}
+
+func (m *Migrator) revert(ctx context.Context, c *sql.Conn, migration Migration) error {
+	log.Println("Reverting MySQL migration", migration.Version, migration.Name)
+	if err := m.run(ctx, c, migration.Down); nil != err {
+		return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+
+	return m.exec(ctx, c, "DELETE FROM "+quoteIdentifier(m.cfg.Table)+" WHERE version = ?", migration.Version)
+}
+
+// run the statements of a migration file
+func (m *Migrator) run(ctx context.Context, c *sql.Conn, script string) error {
+	statements, err := splitStatements(script)
+	if nil != err {
+		return err
+	}
+	for _, statement := range statements {
+		if err := m.exec(ctx, c, statement); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) exec(ctx context.Context, c *sql.Conn, statement string, args ...any) error {
+	if m.cfg.DryRun {
+		log.Println("Dry run:", statement, args)
+		return nil
+	}
+	_, err := c.ExecContext(ctx, statement, args...)
+	return err
+}
+
+// sessionQuerier runs the queries on the session holding the migration lock
+type sessionQuerier struct {
+	c   *sql.Conn
+	loc *time.Location
+}
+
+func (q *sessionQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return q.c.QueryContext(ctx, query, args...)
+}
+
+func (q *sessionQuerier) Location() *time.Location {
+	return q.loc
+}
+
+// read the migration files of the directory, other files are ignored
+func readMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if nil != err {
+		return nil, err
+	}
+
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		match := migrationFileNamePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || nil == match {
+			continue
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if nil != err {
+			return nil, err
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if nil != err {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if match[2] != migration.Name {
+			return nil, fmt.Errorf("%w: %d", ErrDuplicateMigration, version)
+		}
+
+		if "up" == match[3] {
+			sum := sha256.Sum256(content)
+			migration.Up = string(content)
+			migration.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if "" == migration.Checksum {
+			return nil, fmt.Errorf("%w: %d_%s", ErrMissingUpMigration, migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// split a script on the ';' which are not within quotes or comments,
+// empty statements are dropped. DELIMITER is not supported
+func splitStatements(script string) ([]string, error) {
+	statements := make([]string, 0)
+	var current strings.Builder
+	var quote byte // the open quote, 0 when outside of quotes
+
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); "" != statement {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	for idx := 0; idx < len(script); idx++ {
+		ch := script[idx]
+
+		if 0 != quote {
+			current.WriteByte(ch)
+			if '\\' == ch && '`' != quote && idx+1 < len(script) {
+				idx++
+				current.WriteByte(script[idx])
+			} else if quote == ch {
+				quote = 0
+			}
+			continue
+		}
+
+		switch {
+		case '\'' == ch || '"' == ch || '`' == ch:
+			quote = ch
+			current.WriteByte(ch)
+		case '#' == ch || strings.HasPrefix(script[idx:], "-- "):
+			// line comments are dropped
+			end := strings.IndexByte(script[idx:], '\n')
+			if end < 0 {
+				idx = len(script)
+			} else {
+				idx += end
+				current.WriteByte('\n')
+			}
+		case strings.HasPrefix(script[idx:], "/*"):
+			end := strings.Index(script[idx+2:], "*/")
+			if end < 0 {
+				return nil, ErrUnterminatedStatement
+			}
+			// kept as they may be executable comments (/*!50100 ... */)
+			current.WriteString(script[idx : idx+2+end+2])
+			idx += 2 + end + 1
+		case ';' == ch:
+			flush()
+		default:
+			current.WriteByte(ch)
+		}
+	}
+
+	if 0 != quote {
+		return nil, ErrUnterminatedStatement
+	}
+	flush()
+
+	return statements, nil
+}
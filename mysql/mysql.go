@@ -2,12 +2,15 @@ package mysql
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"database/sql"
+	"database/sql/driver"
 
 	"github.com/go-sql-driver/mysql"
 )
@@ -21,12 +24,21 @@ const (
 	defaultMaxIdleConns     = 1
 	defaultMaxOpenConns     = 5
 	defaultMaxLifetime      = 0 // no expiry
+	defaultKillTimeout      = 2 * time.Second
+	defaultKillPoolSize     = 2
 
 	SQLTimeFormatLayout = "2006-01-02 15:04:05"
 )
 
 type MysqlConnector struct {
-	client *sql.DB
+	client           *sql.DB
+	location         *time.Location
+	maxAllowedPacket int
+	queryTimeout     time.Duration
+	killOnCancel     bool
+	connIDs          sync.Map // driver connection -> server connection id
+	killPools        map[*sql.DB]*sql.DB
+	replicas         *replicaSet
 }
 
 type MySQLConfig struct {
@@ -44,13 +56,33 @@ type MySQLConfig struct {
 	MaxIdleConns     int
 	MaxOpenConns     int
 	ConnMaxLifetime  time.Duration
+	// timeout of the queries and of the WithTx transactions whose context has
+	// no deadline, 0 means no timeout
+	QueryTimeout time.Duration
+	// by default the server side query is killed when its context is done,
+	// otherwise only the client connection is dropped and the query keeps
+	// running on the server until it completes
+	DisableKillQuery bool
+	// read replicas sharing the credentials of the primary (Host, Port).
+	// select queries are routed to the healthy replicas, statements and
+	// transactions go to the primary, see ReadFromPrimary
+	Replicas         []ReplicaConfig
+	ReplicaBalancing ReplicaBalancing
+	// interval of the replicas health checks, 0 means 5 seconds
+	ReplicaHealthCheckInterval time.Duration
+	// replicas lagging further behind the primary are ejected until they
+	// catch up, 0 disables the lag check which requires the REPLICATION CLIENT
+	// privilege
+	MaxReplicationLag time.Duration
 }
 
 // return MysqlConnector with setting client to given connection
 // its expected to provide mocked conn while calling this api
 func NewMockedMySQLConnector(conn *sql.DB) *MysqlConnector {
 	return &MysqlConnector{
-		client: conn,
+		client:           conn,
+		location:         time.UTC,
+		maxAllowedPacket: defaultMaxAllowedPacket,
 	}
 }
 
@@ -100,18 +132,62 @@ func NewMySQLConnector(cfg MySQLConfig) (*MysqlConnector, error) {
 		CheckConnLiveness:    true,
 	}
 
-	connector, err := mysql.NewConnector(&mCfg)
+	conn, killConn, err := openDB(mCfg, cfg)
 	if nil != err {
-		log.Println("Failed to create MySQL connector.", err.Error())
 		return nil, err
 	}
-
-	conn := sql.OpenDB(connector)
 	if err := conn.Ping(); nil != err {
 		log.Println("Failed to connect MySQL Server.", err.Error())
+		conn.Close()
+		killConn.Close()
 		return nil, err
 	}
 
+	connector := &MysqlConnector{
+		client:           conn,
+		location:         location,
+		maxAllowedPacket: maxAllowedPacket,
+		queryTimeout:     cfg.QueryTimeout,
+		killOnCancel:     !cfg.DisableKillQuery,
+		killPools:        map[*sql.DB]*sql.DB{conn: killConn},
+	}
+
+	if len(cfg.Replicas) > 0 {
+		replicas := make([]*replica, 0, len(cfg.Replicas))
+		for _, replicaCfg := range cfg.Replicas {
+			rCfg := mCfg
+			rCfg.Addr = fmt.Sprintf("%s:%d", replicaCfg.Host, replicaCfg.Port)
+			client, killClient, err := openDB(rCfg, cfg)
+			if nil != err {
+				conn.Close()
+				killConn.Close()
+				for _, r := range replicas {
+					r.client.Close()
+					r.killClient.Close()
+				}
+				return nil, err
+			}
+			replicas = append(replicas, &replica{addr: rCfg.Addr, client: client, killClient: killClient})
+			connector.killPools[client] = killClient
+		}
+		connector.replicas = newReplicaSet(replicas, cfg)
+	}
+
+	return connector, nil
+}
+
+// create the connection pool of the given server and the small pool used to
+// kill its queries, which must not wait for a connection of the first one
+// as the killed query holds one. no connection is opened
+func openDB(mCfg mysql.Config, cfg MySQLConfig) (*sql.DB, *sql.DB, error) {
+	connector, err := mysql.NewConnector(&mCfg)
+	if nil != err {
+		log.Println("Failed to create MySQL connector.", err.Error())
+		return nil, nil, err
+	}
+
+	conn := sql.OpenDB(connector)
+
 	maxIdleConns := cfg.MaxIdleConns
 	if maxIdleConns <= 0 {
 		maxIdleConns = defaultMaxIdleConns
@@ -130,22 +206,233 @@ func NewMySQLConnector(cfg MySQLConfig) (*MysqlConnector, error) {
 	}
 	conn.SetConnMaxLifetime(maxLifetime)
 
-	return &MysqlConnector{
-		client: conn,
-	}, nil
+	return conn, newKillPool(connector), nil
+}
+
+// return the pool sending KILL QUERY to the server of connector
+func newKillPool(connector driver.Connector) *sql.DB {
+	killConn := sql.OpenDB(connector)
+	killConn.SetMaxOpenConns(defaultKillPoolSize)
+	killConn.SetMaxIdleConns(1)
+	return killConn
 }
 
 // execute the select queries
 func (conn *MysqlConnector) ExecuteSelect(query string, args ...any) (*sql.Rows, error) {
-	return conn.client.Query(query, args...)
+	return conn.QueryContext(context.Background(), query, args...)
 }
 
 func (conn *MysqlConnector) Execute(query string, args ...any) (sql.Result, error) {
-	return conn.client.Exec(query, args...)
+	return conn.ExecContext(context.Background(), query, args...)
+}
+
+// execute the select query bounded by ctx, or by the configured QueryTimeout
+// when ctx has no deadline. the timeout covers reading the rows as well,
+// which must be closed to release the connection
+func (conn *MysqlConnector) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	client := conn.readClient(ctx)
+	ctx, cancel := conn.queryContext(ctx)
+	if nil == ctx.Done() {
+		return client.QueryContext(ctx, query, args...)
+	}
+
+	var rows *sql.Rows
+	c, err := conn.runKillable(ctx, client, func(c *sql.Conn) (err error) {
+		rows, err = c.QueryContext(ctx, query, args...)
+		return
+	})
+	if nil != err {
+		cancel()
+		return nil, err
+	}
+
+	go releaseConn(c, cancel)
+	return rows, nil
+}
+
+// execute the query expected to return at most one row, the connection is
+// released by the Scan of the returned row
+func (conn *MysqlConnector) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	client := conn.readClient(ctx)
+	ctx, cancel := conn.queryContext(ctx)
+	if nil == ctx.Done() {
+		return client.QueryRowContext(ctx, query, args...)
+	}
+
+	var row *sql.Row
+	c, err := conn.runKillable(ctx, client, func(c *sql.Conn) error {
+		row = c.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	if nil == row {
+		// no connection could be acquired and the query did not run, let
+		// the pool retry and report the error through the returned row.
+		// the timeout is released when it fires
+		return client.QueryRowContext(ctx, query, args...)
+	}
+	if nil != err {
+		cancel()
+		return row
+	}
+
+	go releaseConn(c, cancel)
+	return row
+}
+
+// execute the statement bounded by ctx, or by the configured QueryTimeout
+// when ctx has no deadline
+func (conn *MysqlConnector) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, cancel := conn.queryContext(ctx)
+	defer cancel()
+	if nil == ctx.Done() {
+		return conn.client.ExecContext(ctx, query, args...)
+	}
+
+	var result sql.Result
+	c, err := conn.runKillable(ctx, conn.client, func(c *sql.Conn) (err error) {
+		result, err = c.ExecContext(ctx, query, args...)
+		return
+	})
+	if nil != err {
+		return nil, err
+	}
+	c.Close()
+
+	return result, nil
+}
+
+// return the time zone of the DATETIME and TIMESTAMP values
+func (conn *MysqlConnector) Location() *time.Location {
+	return conn.location
+}
+
+// return ctx bounded by the default query timeout when it has no deadline
+func (conn *MysqlConnector) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok && conn.queryTimeout > 0 {
+		return context.WithTimeout(ctx, conn.queryTimeout)
+	}
+	return ctx, func() {}
+}
+
+// run fn on a connection taken from the pool. when ctx is done before fn
+// returns, the statement it runs is killed on the server as the driver only
+// drops the client side of the connection.
+// on success the connection is returned, it must be closed by the caller
+func (conn *MysqlConnector) runKillable(ctx context.Context, client *sql.DB, fn func(c *sql.Conn) error) (*sql.Conn, error) {
+	c, err := client.Conn(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	var id int64
+	if conn.killOnCancel {
+		if id, err = conn.connectionID(ctx, c); nil != err {
+			// the statement reports the connection error if any
+			log.Println("Failed to get MySQL connection id.", err.Error())
+		}
+	}
+	finished := make(chan struct{})
+	watcherDone := make(chan struct{})
+	if 0 == id {
+		close(watcherDone)
+	} else {
+		go func() {
+			defer close(watcherDone)
+			select {
+			case <-ctx.Done():
+				killQuery(conn.killPool(client), id)
+			case <-finished:
+			}
+		}()
+	}
+
+	// the connection must not be reused before a pending kill is sent
+	wait := func() {
+		close(finished)
+		<-watcherDone
+	}
+	defer func() {
+		if p := recover(); nil != p {
+			wait()
+			c.Close()
+			panic(p)
+		}
+	}()
+
+	err = fn(c)
+	wait()
+
+	if nil != err {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// return the server id of the connection, it is cached per driver connection
+func (conn *MysqlConnector) connectionID(ctx context.Context, c *sql.Conn) (int64, error) {
+	var driverConn any
+	c.Raw(func(dc any) error {
+		driverConn = dc
+		return nil
+	})
+
+	if id, ok := conn.connIDs.Load(driverConn); ok {
+		return id.(int64), nil
+	}
+
+	var id int64
+	if err := c.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&id); nil != err {
+		return 0, err
+	}
+
+	// forget the connections closed by the pool
+	conn.connIDs.Range(func(key, _ any) bool {
+		if validator, ok := key.(driver.Validator); ok && !validator.IsValid() {
+			conn.connIDs.Delete(key)
+		}
+		return true
+	})
+	conn.connIDs.Store(driverConn, id)
+
+	return id, nil
+}
+
+// return the pool killing the queries of client, client itself when it has
+// none (mocked connectors)
+func (conn *MysqlConnector) killPool(client *sql.DB) *sql.DB {
+	if killClient, ok := conn.killPools[client]; ok {
+		return killClient
+	}
+	return client
+}
+
+// kill the statement running on the given server connection
+func killQuery(client *sql.DB, id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultKillTimeout)
+	defer cancel()
+
+	if _, err := client.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", id)); nil != err {
+		log.Println("Failed to kill MySQL query.", err.Error())
+	}
+}
+
+// return the connection to the pool once its rows are closed
+func releaseConn(c *sql.Conn, cancel context.CancelFunc) {
+	// Close blocks until the rows are closed
+	c.Close()
+	cancel()
 }
 
 // close the Aerospike client connection
 func (conn *MysqlConnector) Close() {
+	if nil != conn.replicas {
+		conn.replicas.close()
+	}
+
+	if killConn, ok := conn.killPools[conn.client]; ok {
+		killConn.Close()
+	}
 	if err := conn.client.Close(); nil != err {
 		log.Println("Error while closing MySQL connection!!! ", err.Error())
 	} else {
@@ -153,11 +440,11 @@ func (conn *MysqlConnector) Close() {
 	}
 }
 
-// to use this function ensure that mysql connection user have
-// select privileges on  INFORMATION_SCHEMA.PARTITIONS
-// retrun true if data is updated in the table
-func (conn *MysqlConnector) CheckTableUpdatedSince(database string, tables []string, time time.Time) (updated bool, err error) {
-	values := make([]any, 0)
+// return the query selecting the columns of the INFORMATION_SCHEMA.PARTITIONS
+// rows of the tables and its arguments, conditions can be appended to it.
+// tables must not be empty
+func partitionsQuery(columns string, database string, tables []string) (*bytes.Buffer, []any) {
+	values := make([]any, 0, len(tables)+1)
 	values = append(values, database)
 	for _, table := range tables {
 		values = append(values, table)
@@ -166,17 +453,30 @@ func (conn *MysqlConnector) CheckTableUpdatedSince(database string, tables []str
 	placeHolder := strings.Repeat("?,", len(tables))
 	placeHolder = placeHolder[:len(placeHolder)-1]
 
-	values = append(values, time.Format(SQLTimeFormatLayout))
-	values = append(values, time.Format(SQLTimeFormatLayout))
-
-	var buff bytes.Buffer
-	buff.WriteString("SELECT UPDATE_TIME ")
-	buff.WriteString("FROM  INFORMATION_SCHEMA.PARTITIONS ")
-	buff.WriteString("WHERE TABLE_SCHEMA =  ?")
+	buff := &bytes.Buffer{}
+	buff.WriteString("SELECT ")
+	buff.WriteString(columns)
+	buff.WriteString(" FROM INFORMATION_SCHEMA.PARTITIONS")
+	buff.WriteString(" WHERE TABLE_SCHEMA = ?")
 	buff.WriteString(" AND TABLE_NAME IN (")
 	buff.WriteString(placeHolder)
 	buff.WriteString(")")
+
+	return buff, values
+}
+
+// to use this function ensure that mysql connection user have
+// select privileges on  INFORMATION_SCHEMA.PARTITIONS
+// retrun true if data is updated in the table
+func (conn *MysqlConnector) CheckTableUpdatedSince(database string, tables []string, time time.Time) (updated bool, err error) {
+	if 0 == len(tables) {
+		return
+	}
+
+	buff, values := partitionsQuery("UPDATE_TIME", database, tables)
 	buff.WriteString(" AND (UPDATE_TIME >= ? OR CREATE_TIME >= ?)")
+	values = append(values, time.Format(SQLTimeFormatLayout))
+	values = append(values, time.Format(SQLTimeFormatLayout))
 
 	row, er := conn.ExecuteSelect(buff.String(), values...)
 	for {
@@ -0,0 +1,940 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeResult is the answer of the fake server to a statement
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+	err      error
+}
+
+// fakeServer is a database/sql connector recording the statements it gets
+// and answering them with its handler
+type fakeServer struct {
+	mu      sync.Mutex
+	queries []string
+	connIDs int64
+	handler func(ctx context.Context, query string, args []driver.NamedValue) fakeResult
+}
+
+func newFakeConnector(handler func(ctx context.Context, query string, args []driver.NamedValue) fakeResult) (*MysqlConnector, *fakeServer) {
+	server := &fakeServer{handler: handler}
+	return NewMockedMySQLConnector(sql.OpenDB(server)), server
+}
+
+func (server *fakeServer) Connect(context.Context) (driver.Conn, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.connIDs++
+	return &fakeConn{server: server, id: server.connIDs}, nil
+}
+
+func (server *fakeServer) Driver() driver.Driver { return nil }
+
+// return the statements received so far
+func (server *fakeServer) Queries() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]string(nil), server.queries...)
+}
+
+func (server *fakeServer) run(ctx context.Context, id int64, query string, args []driver.NamedValue) fakeResult {
+	server.mu.Lock()
+	server.queries = append(server.queries, query)
+	server.mu.Unlock()
+
+	if "SELECT CONNECTION_ID()" == query {
+		return fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{id}}}
+	}
+	if nil == server.handler {
+		return fakeResult{}
+	}
+	return server.handler(ctx, query, args)
+}
+
+type fakeConn struct {
+	server *fakeServer
+	id     int64
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	return c.server.run(ctx, c.id, "PING", nil).err
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if res := c.server.run(ctx, c.id, "BEGIN", nil); nil != res.err {
+		return nil, res.err
+	}
+	return &fakeTx{conn: c}, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res := c.server.run(ctx, c.id, query, args)
+	if nil != res.err {
+		return nil, res.err
+	}
+	return &fakeRows{columns: res.columns, rows: res.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res := c.server.run(ctx, c.id, query, args)
+	if nil != res.err {
+		return nil, res.err
+	}
+	return driver.RowsAffected(res.affected), nil
+}
+
+type fakeTx struct {
+	conn *fakeConn
+}
+
+func (tx *fakeTx) Commit() error {
+	return tx.conn.server.run(context.Background(), tx.conn.id, "COMMIT", nil).err
+}
+
+func (tx *fakeTx) Rollback() error {
+	return tx.conn.server.run(context.Background(), tx.conn.id, "ROLLBACK", nil).err
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (rows *fakeRows) Columns() []string { return rows.columns }
+
+func (rows *fakeRows) Close() error { return nil }
+
+func (rows *fakeRows) Next(dest []driver.Value) error {
+	if 0 == len(rows.rows) {
+		return io.EOF
+	}
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
+
+// wait for the connections of the pool to be released
+func waitIdle(t *testing.T, conn *MysqlConnector) {
+	deadline := time.Now().Add(time.Second)
+	for 0 != conn.client.Stats().InUse {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected all connections to be released, %d in use", conn.client.Stats().InUse)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	conn, server := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		switch {
+		case strings.HasPrefix(query, "SELECT SLEEP"):
+			<-ctx.Done()
+			return fakeResult{err: ctx.Err()}
+		case strings.HasPrefix(query, "SELECT"):
+			return fakeResult{columns: []string{"value"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}
+		}
+		return fakeResult{affected: 3}
+	})
+	conn.queryTimeout = 50 * time.Millisecond
+	conn.killOnCancel = true
+
+	start := time.Now()
+	if _, err := conn.ExecuteSelect("SELECT SLEEP(10)"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the default timeout to apply, took %v", elapsed)
+	}
+
+	queries := server.Queries()
+	if "KILL QUERY 1" != queries[len(queries)-1] {
+		t.Errorf("Expected the query to be killed, got %v", queries)
+	}
+
+	rows, err := conn.QueryContext(context.Background(), "SELECT value FROM t")
+	if nil != err {
+		t.Fatal(err)
+	}
+	var sum int64
+	for rows.Next() {
+		var value int64
+		rows.Scan(&value)
+		sum += value
+	}
+	rows.Close()
+	if 3 != sum {
+		t.Errorf("Expected sum 3, got %d", sum)
+	}
+
+	var value int64
+	if err := conn.QueryRowContext(context.Background(), "SELECT value FROM t").Scan(&value); nil != err || 1 != value {
+		t.Errorf("Expected 1, got %d %v", value, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := conn.ExecContext(ctx, "DELETE FROM t")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if affected, _ := result.RowsAffected(); 3 != affected {
+		t.Errorf("Expected 3 rows affected, got %d", affected)
+	}
+
+	waitIdle(t, conn)
+
+	// the connection id is only queried once per connection
+	count := 0
+	for _, query := range server.Queries() {
+		if "SELECT CONNECTION_ID()" == query {
+			count++
+		}
+	}
+	server.mu.Lock()
+	conns := int(server.connIDs)
+	server.mu.Unlock()
+	if count != conns {
+		t.Errorf("Expected %d connection id queries, got %d", conns, count)
+	}
+}
+
+func TestKillQuerySaturatedPool(t *testing.T) {
+	conn, server := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		if strings.HasPrefix(query, "SELECT SLEEP") {
+			<-ctx.Done()
+			return fakeResult{err: ctx.Err()}
+		}
+		return fakeResult{}
+	})
+	conn.queryTimeout = 50 * time.Millisecond
+	conn.killOnCancel = true
+	// the killed query holds the only connection of the pool
+	conn.client.SetMaxOpenConns(1)
+	conn.killPools = map[*sql.DB]*sql.DB{conn.client: newKillPool(server)}
+	defer conn.killPools[conn.client].Close()
+
+	start := time.Now()
+	if _, err := conn.ExecuteSelect("SELECT SLEEP(10)"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the kill not to wait for the pool, took %v", elapsed)
+	}
+
+	queries := server.Queries()
+	if "KILL QUERY 1" != queries[len(queries)-1] {
+		t.Errorf("Expected the query to be killed, got %v", queries)
+	}
+	waitIdle(t, conn)
+}
+
+func TestWithTx(t *testing.T) {
+	var deadlocks int32
+	conn, server := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		switch query {
+		case "UPDATE t SET v = 1":
+			if atomic.AddInt32(&deadlocks, 1) <= 2 {
+				return fakeResult{err: &mysql.MySQLError{Number: errLockDeadlock, Message: "Deadlock found"}}
+			}
+		case "INSERT INTO t VALUES (2)":
+			return fakeResult{err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}}
+		}
+		return fakeResult{affected: 1}
+	})
+	ctx := context.Background()
+
+	err := conn.WithTx(ctx, &TxOptions{RetryBackoff: time.Millisecond}, func(tx *Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE t SET v = 1"); nil != err {
+			return err
+		}
+		// a failed sub-operation does not abort the transaction
+		tx.Savepoint(ctx, func(tx *Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (2)")
+			return err
+		})
+		return tx.Savepoint(ctx, func(tx *Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (3)")
+			return err
+		})
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"BEGIN", "UPDATE t SET v = 1", "ROLLBACK",
+		"BEGIN", "UPDATE t SET v = 1", "ROLLBACK",
+		"BEGIN", "UPDATE t SET v = 1",
+		"SAVEPOINT sp_1", "INSERT INTO t VALUES (2)", "ROLLBACK TO SAVEPOINT sp_1",
+		"SAVEPOINT sp_2", "INSERT INTO t VALUES (3)", "RELEASE SAVEPOINT sp_2",
+		"COMMIT",
+	}
+	if queries := server.Queries(); strings.Join(expected, ";") != strings.Join(queries, ";") {
+		t.Errorf("Unexpected statements %v", queries)
+	}
+
+	// retries are bounded
+	atomic.StoreInt32(&deadlocks, -10)
+	err = conn.WithTx(ctx, &TxOptions{MaxRetries: 1, RetryBackoff: time.Millisecond}, func(tx *Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE t SET v = 1")
+		return err
+	})
+	if !IsRetryableTxError(err) || -8 != atomic.LoadInt32(&deadlocks) {
+		t.Errorf("Expected a single retry, got %d attempts and %v", atomic.LoadInt32(&deadlocks)+10, err)
+	}
+
+	func() {
+		defer func() {
+			if nil == recover() {
+				t.Error("Expected the panic to be propagated")
+			}
+		}()
+		conn.WithTx(ctx, nil, func(tx *Tx) error {
+			panic("boom")
+		})
+	}()
+	if queries := server.Queries(); "ROLLBACK" != queries[len(queries)-1] {
+		t.Errorf("Expected a rollback on panic, got %v", queries)
+	}
+	waitIdle(t, conn)
+}
+
+type auditFields struct {
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt *time.Time `db:"updated_at"`
+}
+
+type Owner struct {
+	OwnerName string `db:"owner"`
+}
+
+type campaign struct {
+	auditFields
+	*Owner
+	ID       int64           `db:"id"`
+	Name     string          // matched by name
+	Budget   sql.NullFloat64 `db:"budget"`
+	Note     sql.NullString  `db:"note"`
+	EndsAt   sql.NullTime    `db:"ends_at"`
+	Internal string          `db:"-"`
+}
+
+func TestSavepointRollbackFailure(t *testing.T) {
+	conn, _ := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		switch query {
+		case "UPDATE t SET v = 1":
+			return fakeResult{err: &mysql.MySQLError{Number: errLockWaitTimeout, Message: "Lock wait timeout exceeded"}}
+		case "ROLLBACK TO SAVEPOINT sp_1":
+			return fakeResult{err: &mysql.MySQLError{Number: 1305, Message: "SAVEPOINT sp_1 does not exist"}}
+		}
+		return fakeResult{affected: 1}
+	})
+	ctx := context.Background()
+
+	err := conn.WithTx(ctx, &TxOptions{MaxRetries: -1}, func(tx *Tx) error {
+		return tx.Savepoint(ctx, func(tx *Tx) error {
+			_, err := tx.ExecContext(ctx, "UPDATE t SET v = 1")
+			return err
+		})
+	})
+	if !IsRetryableTxError(err) || !strings.Contains(err.Error(), "1305") {
+		t.Errorf("Expected the lock wait timeout to be kept, got %v", err)
+	}
+	waitIdle(t, conn)
+}
+
+func TestWithTxTimeout(t *testing.T) {
+	killed := make(chan struct{})
+	conn, server := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		switch {
+		case strings.HasPrefix(query, "KILL QUERY"):
+			close(killed)
+		case strings.HasPrefix(query, "SELECT SLEEP"):
+			select {
+			case <-ctx.Done():
+			case <-killed:
+			}
+			return fakeResult{err: errors.New("query execution was interrupted")}
+		}
+		return fakeResult{affected: 1}
+	})
+	conn.queryTimeout = 50 * time.Millisecond
+	conn.killOnCancel = true
+	ctx := context.Background()
+
+	start := time.Now()
+	err := conn.WithTx(ctx, nil, func(tx *Tx) error {
+		_, err := tx.ExecContext(ctx, "SELECT SLEEP(10)")
+		return err
+	})
+	if nil == err {
+		t.Error("Expected the transaction to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the default timeout to apply, took %v", elapsed)
+	}
+
+	queries := server.Queries()
+	if !strings.HasPrefix(strings.Join(queries, ";"), "SELECT CONNECTION_ID();BEGIN;SELECT SLEEP(10);KILL QUERY 1") {
+		t.Errorf("Expected the statement to be killed, got %v", queries)
+	}
+	waitIdle(t, conn)
+}
+
+func TestQueryInto(t *testing.T) {
+	conn, _ := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		if "SELECT COUNT(*) FROM campaign" == query {
+			return fakeResult{columns: []string{"count"}, rows: [][]driver.Value{{int64(2)}}}
+		}
+		if strings.Contains(query, "WHERE id = 0") {
+			return fakeResult{columns: []string{"id"}}
+		}
+		return fakeResult{
+			columns: []string{"id", "NAME", "budget", "note", "created_at", "updated_at", "ends_at", "owner", "Internal", "extra"},
+			rows: [][]driver.Value{
+				{int64(1), []byte("spring"), 12.5, nil, []byte("2023-03-01 10:00:00"), nil, nil, []byte("acme"), []byte("x"), int64(7)},
+				{int64(2), []byte("summer"), nil, []byte("vip"), []byte("2023-06-01 08:30:00.123456"), []byte("2023-06-02 00:00:00"), []byte("2023-09-01"), []byte("beta"), nil, nil},
+			},
+		}
+	})
+	loc, _ := time.LoadLocation("Asia/Kolkata")
+	if nil == loc {
+		loc = time.FixedZone("IST", 5*3600+1800)
+	}
+	conn.location = loc
+	ctx := context.Background()
+
+	campaigns, err := QueryInto[campaign](ctx, conn, "SELECT * FROM campaign")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(campaigns) {
+		t.Fatalf("Expected 2 campaigns, got %d", len(campaigns))
+	}
+
+	first, second := campaigns[0], campaigns[1]
+	if 1 != first.ID || "spring" != first.Name || !first.Budget.Valid || 12.5 != first.Budget.Float64 ||
+		first.Note.Valid || nil == first.Owner || "acme" != first.OwnerName || "" != first.Internal {
+		t.Errorf("Unexpected first campaign %+v", first)
+	}
+	if expected := time.Date(2023, 3, 1, 10, 0, 0, 0, loc); !first.CreatedAt.Equal(expected) || loc != first.CreatedAt.Location() {
+		t.Errorf("Expected %v, got %v", expected, first.CreatedAt)
+	}
+	if nil != first.UpdatedAt || first.EndsAt.Valid {
+		t.Errorf("Expected null times, got %v %v", first.UpdatedAt, first.EndsAt)
+	}
+	if second.Budget.Valid || "vip" != second.Note.String || nil == second.UpdatedAt ||
+		!second.EndsAt.Valid || 9 != second.EndsAt.Time.Month() || 123456000 != second.CreatedAt.Nanosecond() {
+		t.Errorf("Unexpected second campaign %+v", second)
+	}
+
+	count, err := QueryOne[int64](ctx, conn, "SELECT COUNT(*) FROM campaign")
+	if nil != err || 2 != count {
+		t.Errorf("Expected count 2, got %d %v", count, err)
+	}
+	if _, err := QueryOne[campaign](ctx, conn, "SELECT * FROM campaign WHERE id = 0"); sql.ErrNoRows != err {
+		t.Errorf("Expected no rows, got %v", err)
+	}
+	if _, err := QueryInto[int64](ctx, conn, "SELECT * FROM campaign"); ErrScalarColumns != err {
+		t.Errorf("Expected scalar columns error, got %v", err)
+	}
+
+	// stopping early releases the connection as well
+	it, err := QueryIterator[campaign](ctx, conn, "SELECT * FROM campaign")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !it.Next() || "spring" != it.Value().Name {
+		t.Errorf("Unexpected first row %+v %v", it.Value(), it.Err())
+	}
+	it.Close()
+	if it.Next() {
+		t.Error("Expected no row after Close")
+	}
+	waitIdle(t, conn)
+}
+
+func TestBulkInsert(t *testing.T) {
+	conn, server := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		return fakeResult{affected: int64(len(args) / 2)}
+	})
+	conn.maxAllowedPacket = packetOverhead + 200
+	ctx := context.Background()
+
+	bulk := conn.NewBulkInsert("stats.campaign", "id", "name").
+		Ignore().
+		OnDuplicateKeyUpdate("name")
+	for idx := 0; idx < 10; idx++ {
+		bulk.AddRow(idx, fmt.Sprintf("campaign-%d", idx))
+	}
+	affected, err := bulk.Exec(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for _, count := range affected {
+		total += count
+	}
+	queries := server.Queries()
+	if len(affected) < 2 || 10 != total || len(queries) != len(affected) {
+		t.Errorf("Expected the rows to be split in chunks, got %v for %d statements", affected, len(queries))
+	}
+	expected := "INSERT IGNORE INTO `stats`.`campaign` (`id`,`name`) VALUES (?,?),"
+	if !strings.HasPrefix(queries[0], expected) || !strings.HasSuffix(queries[0], "(?,?) ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)") {
+		t.Errorf("Unexpected statement %s", queries[0])
+	}
+	for _, query := range queries {
+		if len(query) > conn.maxAllowedPacket {
+			t.Errorf("Statement exceeds the packet size: %s", query)
+		}
+	}
+
+	type row struct {
+		Owner
+		ID   int64 `db:"id"`
+		Name string
+	}
+	if _, err := conn.NewBulkInsert("campaign", "id", "name", "owner").AddStruct(&row{ID: 1, Name: "a"}).Exec(ctx); nil != err {
+		t.Error(err)
+	}
+	if _, err := conn.NewBulkInsert("campaign", "id", "missing").AddStruct(row{}).Exec(ctx); !errors.Is(err, ErrUnmappedColumn) {
+		t.Errorf("Expected unmapped column error, got %v", err)
+	}
+	if _, err := conn.NewBulkInsert("campaign", "id").AddRow(1, 2).Exec(ctx); ErrColumnCount != err {
+		t.Errorf("Expected column count error, got %v", err)
+	}
+	if _, err := conn.NewBulkInsert("campaign", "id").AddRow(strings.Repeat("x", 300)).Exec(ctx); ErrRowTooLarge != err {
+		t.Errorf("Expected row too large error, got %v", err)
+	}
+
+	// nullable fields are sized by the value they point to
+	large := strings.Repeat("x", 300)
+	type nullableRow struct {
+		Name *string `db:"name"`
+	}
+	if _, err := conn.NewBulkInsert("campaign", "name").AddStruct(nullableRow{Name: &large}).Exec(ctx); ErrRowTooLarge != err {
+		t.Errorf("Expected row too large error for a pointer field, got %v", err)
+	}
+	if 4 != paramSize((*string)(nil)) || 4+9+300 != paramSize(&large) {
+		t.Errorf("Unexpected pointer sizes %d, %d", paramSize((*string)(nil)), paramSize(&large))
+	}
+}
+
+func TestReplicaRouting(t *testing.T) {
+	conn, primary := newFakeConnector(nil)
+	var lagging int32
+	replicaServers := make([]*fakeServer, 0)
+	replicas := make([]*replica, 0)
+	for idx := 0; idx < 2; idx++ {
+		idx := idx
+		server := &fakeServer{handler: func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+			if "SHOW REPLICA STATUS" != query {
+				return fakeResult{columns: []string{"value"}, rows: [][]driver.Value{{int64(idx)}}}
+			}
+			lag := []byte("0")
+			if 1 == idx && 1 == atomic.LoadInt32(&lagging) {
+				lag = []byte("120")
+			}
+			return fakeResult{
+				columns: []string{"Replica_IO_State", "Seconds_Behind_Source"},
+				rows:    [][]driver.Value{{[]byte("Waiting for source to send event"), lag}},
+			}
+		}}
+		replicaServers = append(replicaServers, server)
+		replicas = append(replicas, &replica{addr: fmt.Sprintf("replica-%d", idx), client: sql.OpenDB(server)})
+	}
+	conn.replicas = newReplicaSet(replicas, MySQLConfig{
+		ReplicaHealthCheckInterval: time.Hour,
+		MaxReplicationLag:          time.Minute,
+	})
+	defer conn.Close()
+	ctx := context.Background()
+
+	reads := make(map[int64]int)
+	for idx := 0; idx < 4; idx++ {
+		value, err := QueryOne[int64](ctx, conn, "SELECT value FROM t")
+		if nil != err {
+			t.Fatal(err)
+		}
+		reads[value]++
+	}
+	if 2 != reads[0] || 2 != reads[1] {
+		t.Errorf("Expected the reads to be spread over the replicas, got %v", reads)
+	}
+
+	conn.ExecuteSelect("SELECT 1")
+	conn.QueryRowContext(ReadFromPrimary(ctx), "SELECT 2").Scan(new(int64))
+	conn.Execute("UPDATE t SET value = 1")
+	conn.WithTx(ctx, nil, func(tx *Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM t")
+		return err
+	})
+	expected := "SELECT 2;UPDATE t SET value = 1;BEGIN;DELETE FROM t;COMMIT"
+	if queries := primary.Queries(); expected != strings.Join(queries, ";") {
+		t.Errorf("Unexpected primary statements %v", queries)
+	}
+
+	// a lagging replica is ejected until it catches up
+	atomic.StoreInt32(&lagging, 1)
+	conn.replicas.checkAll()
+	status := conn.ReplicaStatus()
+	if !status[0].Healthy || status[1].Healthy || 2*time.Minute != status[1].Lag {
+		t.Errorf("Unexpected replica status %+v", status)
+	}
+	for idx := 0; idx < 3; idx++ {
+		if value, _ := QueryOne[int64](ctx, conn, "SELECT value FROM t"); 0 != value {
+			t.Errorf("Expected reads on the healthy replica only, got replica %d", value)
+		}
+	}
+
+	atomic.StoreInt32(&lagging, 0)
+	conn.replicas.checkAll()
+	if status := conn.ReplicaStatus(); !status[1].Healthy {
+		t.Errorf("Expected the replica to be back, got %+v", status)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	var mu sync.Mutex
+	tracked := make(map[uint64][]driver.Value)
+	lockFree := true
+	conn, server := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(query, "SELECT GET_LOCK"):
+			acquired := int64(0)
+			if lockFree {
+				acquired = 1
+			}
+			return fakeResult{columns: []string{"lock"}, rows: [][]driver.Value{{acquired}}}
+		case strings.HasPrefix(query, "SELECT version"):
+			rows := make([][]driver.Value, 0)
+			for _, row := range tracked {
+				rows = append(rows, row)
+			}
+			return fakeResult{columns: []string{"version", "name", "checksum", "applied_at"}, rows: rows}
+		case strings.HasPrefix(query, "INSERT INTO `schema_migrations`"):
+			version := uint64(args[0].Value.(int64))
+			tracked[version] = []driver.Value{args[0].Value, []byte(args[1].Value.(string)), []byte(args[2].Value.(string)), []byte("2023-01-01 00:00:00")}
+		case strings.HasPrefix(query, "DELETE FROM `schema_migrations`"):
+			delete(tracked, uint64(args[0].Value.(int64)))
+		}
+		return fakeResult{}
+	})
+	ctx := context.Background()
+
+	files := fstest.MapFS{
+		"migrations/001_campaign.up.sql":   {Data: []byte("CREATE TABLE campaign (id INT, name VARCHAR(64) DEFAULT 'a;b');\n-- the index;\nCREATE INDEX name ON campaign (name);")},
+		"migrations/001_campaign.down.sql": {Data: []byte("DROP TABLE campaign;")},
+		"migrations/002_budget.up.sql":     {Data: []byte("ALTER TABLE campaign ADD budget INT /* in cents; */")},
+		"migrations/002_budget.down.sql":   {Data: []byte("ALTER TABLE campaign DROP budget")},
+		"migrations/003_owner.up.sql":      {Data: []byte("ALTER TABLE campaign ADD owner INT;")},
+		"migrations/README.md":             {Data: []byte("ignored")},
+	}
+	migrator, err := conn.NewMigrator(MigrationConfig{FS: files, Dir: "migrations"})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// statements run by the migrations, without the tracking ones
+	statements := func() []string {
+		list := make([]string, 0)
+		for _, query := range server.Queries() {
+			if strings.HasPrefix(query, "CREATE TABLE campaign") || strings.HasPrefix(query, "CREATE INDEX") ||
+				strings.HasPrefix(query, "ALTER") || strings.HasPrefix(query, "DROP") {
+				list = append(list, query)
+			}
+		}
+		server.mu.Lock()
+		server.queries = nil
+		server.mu.Unlock()
+		return list
+	}
+
+	if _, err := migrator.MigrateTo(ctx, 2); nil != err {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"CREATE TABLE campaign (id INT, name VARCHAR(64) DEFAULT 'a;b')",
+		"CREATE INDEX name ON campaign (name)",
+		"ALTER TABLE campaign ADD budget INT /* in cents; */",
+	}
+	if list := statements(); strings.Join(expected, "|") != strings.Join(list, "|") {
+		t.Errorf("Unexpected statements %q", list)
+	}
+
+	// dry run only plans the pending migration
+	dryRun, _ := conn.NewMigrator(MigrationConfig{FS: files, Dir: "migrations", DryRun: true})
+	if done, err := dryRun.Migrate(ctx); nil != err || 1 != len(done) || 3 != done[0].Version {
+		t.Errorf("Expected migration 3 to be planned, got %v %v", done, err)
+	}
+	if list := statements(); 0 != len(list) {
+		t.Errorf("Expected no statement on dry run, got %q", list)
+	}
+
+	if done, err := migrator.Migrate(ctx); nil != err || 1 != len(done) {
+		t.Errorf("Expected migration 3 to be applied, got %v %v", done, err)
+	}
+	statements()
+
+	// migration 3 has no down file
+	if _, err := migrator.MigrateTo(ctx, 1); !errors.Is(err, ErrMissingDownMigration) {
+		t.Errorf("Expected missing down migration, got %v", err)
+	}
+	mu.Lock()
+	delete(tracked, 3)
+	mu.Unlock()
+	if done, err := migrator.MigrateTo(ctx, 1); nil != err || 1 != len(done) || 2 != done[0].Version {
+		t.Errorf("Expected migration 2 to be reverted, got %v %v", done, err)
+	}
+	if list := statements(); 1 != len(list) || "ALTER TABLE campaign DROP budget" != list[0] {
+		t.Errorf("Unexpected statements %q", list)
+	}
+	if applied, err := migrator.Applied(ctx); nil != err || 1 != len(applied) || 1 != applied[0].Version {
+		t.Errorf("Expected migration 1 to be applied, got %v %v", applied, err)
+	}
+
+	files["migrations/001_campaign.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE campaign (id BIGINT);")}
+	modified, _ := conn.NewMigrator(MigrationConfig{FS: files, Dir: "migrations"})
+	if _, err := modified.Migrate(ctx); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected checksum mismatch, got %v", err)
+	}
+
+	mu.Lock()
+	lockFree = false
+	mu.Unlock()
+	if _, err := migrator.Migrate(ctx); ErrMigrationLocked != err {
+		t.Errorf("Expected lock error, got %v", err)
+	}
+	waitIdle(t, conn)
+}
+
+func TestTableWatcher(t *testing.T) {
+	var mu sync.Mutex
+	updateTime := []byte("2023-01-01 10:00:00")
+	checksum := int64(100)
+	failing := false
+	conn, server := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return fakeResult{err: errors.New("server gone")}
+		}
+		if "SELECT TABLE_NAME AS table_name, MAX(UPDATE_TIME) AS update_time FROM INFORMATION_SCHEMA.PARTITIONS WHERE TABLE_SCHEMA = ? AND TABLE_NAME IN (?,?) GROUP BY TABLE_NAME" == query {
+			return fakeResult{
+				columns: []string{"table_name", "update_time"},
+				rows:    [][]driver.Value{{[]byte("Campaign"), updateTime}, {[]byte("publisher"), nil}},
+			}
+		}
+		if "CHECKSUM TABLE `ads`.`publisher`" == query {
+			return fakeResult{columns: []string{"Table", "Checksum"}, rows: [][]driver.Value{{[]byte("ads.publisher"), checksum}}}
+		}
+		return fakeResult{err: errors.New("unexpected query " + query)}
+	})
+
+	if _, err := conn.NewTableWatcher(TableWatcherConfig{Database: "ads"}); ErrNoTables != err {
+		t.Errorf("Expected ErrNoTables, got %v", err)
+	}
+
+	watcher, err := conn.NewTableWatcher(TableWatcherConfig{
+		Database:   "ads",
+		Tables:     []string{"campaign", "publisher"},
+		Interval:   5 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	// stopping a watcher which never started does nothing, starting it twice
+	// runs a single poller
+	idle, _ := conn.NewTableWatcher(TableWatcherConfig{Database: "ads", Tables: []string{"campaign"}, Interval: time.Hour})
+	idle.Stop()
+	idle.Start()
+	idle.Start()
+	time.Sleep(20 * time.Millisecond)
+	idle.Stop()
+	idle.Stop()
+	polls := 0
+	for _, query := range server.Queries() {
+		if strings.HasSuffix(query, "IN (?) GROUP BY TABLE_NAME") {
+			polls++
+		}
+	}
+	if 1 != polls {
+		t.Errorf("Expected a single poller, got %d polls", polls)
+	}
+
+	notifications := make(chan []string, 10)
+	watcher.OnChange(func(changed []string) { notifications <- changed })
+	watcher.Start()
+	defer watcher.Stop()
+
+	expectChange := func(expected string) {
+		select {
+		case changed := <-notifications:
+			if expected != strings.Join(changed, ",") {
+				t.Errorf("Expected %s to change, got %v", expected, changed)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %s to change", expected)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case changed := <-notifications:
+		t.Errorf("Expected no change before an update, got %v", changed)
+	default:
+	}
+	if lastSeen := watcher.LastSeen(); 10 != lastSeen["campaign"].Hour() || 1 != len(lastSeen) {
+		t.Errorf("Unexpected last seen update times %v", lastSeen)
+	}
+
+	mu.Lock()
+	updateTime = []byte("2023-01-01 10:00:05")
+	mu.Unlock()
+	expectChange("campaign")
+
+	// errors back off and the polling resumes afterwards
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	failing = false
+	checksum = 101
+	updateTime = []byte("2023-01-01 10:00:09")
+	mu.Unlock()
+	expectChange("campaign,publisher")
+
+	watcher.Stop()
+}
+
+func TestLookupTable(t *testing.T) {
+	type publisher struct {
+		ID   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+
+	var mu sync.Mutex
+	rows := [][]driver.Value{{int64(1), []byte("alpha")}, {int64(2), []byte("beta")}}
+	updateTime := []byte("2023-01-01 10:00:00")
+	failing := false
+	conn, _ := newFakeConnector(func(ctx context.Context, query string, args []driver.NamedValue) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(query, "SELECT TABLE_NAME") {
+			return fakeResult{columns: []string{"table_name", "update_time"}, rows: [][]driver.Value{{[]byte("publisher"), updateTime}}}
+		}
+		if failing {
+			return fakeResult{err: errors.New("server gone")}
+		}
+		return fakeResult{columns: []string{"id", "name"}, rows: append([][]driver.Value(nil), rows...)}
+	})
+	ctx := context.Background()
+
+	watcher, err := conn.NewTableWatcher(TableWatcherConfig{Database: "ads", Tables: []string{"publisher"}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	watcher.Poll(ctx)
+
+	if _, err := NewLookupTable(ctx, conn, LookupTableConfig[int64, publisher]{Query: "SELECT id, name FROM publisher"}); ErrNoLookupKey != err {
+		t.Errorf("Expected ErrNoLookupKey without a key, got %v", err)
+	}
+
+	publishers, err := NewLookupTable(ctx, conn, LookupTableConfig[int64, publisher]{
+		Query:   "SELECT id, name FROM publisher",
+		Key:     func(p publisher) int64 { return p.ID },
+		Watcher: watcher,
+		Tables:  []string{"publisher"},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer publishers.Close()
+
+	if p, ok := publishers.Get(2); !ok || "beta" != p.Name || 2 != publishers.Len() {
+		t.Errorf("Unexpected lookup %+v %v %d", p, ok, publishers.Len())
+	}
+	firstRefresh := publishers.LastRefresh()
+
+	// reloaded when the watcher reports a change
+	mu.Lock()
+	rows = append(rows, []driver.Value{int64(3), []byte("gamma")})
+	updateTime = []byte("2023-01-01 10:00:01")
+	mu.Unlock()
+	if changed, _ := watcher.Poll(ctx); 1 != len(changed) {
+		t.Fatalf("Expected the table to change, got %v", changed)
+	}
+	if _, ok := publishers.Get(3); !ok || 3 != publishers.Len() || !publishers.LastRefresh().After(firstRefresh) {
+		t.Errorf("Expected the new row after the reload, got %d rows", publishers.Len())
+	}
+
+	// the last good copy is kept on failure
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if err := publishers.Refresh(ctx); nil == err || nil == publishers.LastError() {
+		t.Error("Expected the refresh to fail")
+	}
+	if 3 != publishers.Len() {
+		t.Errorf("Expected the last copy to be kept, got %d rows", publishers.Len())
+	}
+
+	// periodic reload
+	mu.Lock()
+	failing = false
+	rows = rows[:1]
+	mu.Unlock()
+	periodic, err := NewLookupTable(ctx, conn, LookupTableConfig[string, publisher]{
+		Query:           "SELECT id, name FROM publisher",
+		Key:             func(p publisher) string { return p.Name },
+		RefreshInterval: 5 * time.Millisecond,
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer periodic.Close()
+	mu.Lock()
+	rows = append(rows, []driver.Value{int64(4), []byte("delta")})
+	mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for 2 != periodic.Len() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := periodic.Get("delta"); !ok {
+		t.Error("Expected the periodic refresh to load the new row")
+	}
+}
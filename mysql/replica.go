@@ -0,0 +1,275 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	defaultReplicaHealthCheckInterval = 5 * time.Second
+	defaultReplicaHealthCheckTimeout  = 1 * time.Second
+
+	errParse = 1064 // ER_PARSE_ERROR
+)
+
+var (
+	ErrReplicationStopped = errors.New("Replication Is Not Running")
+)
+
+// ReplicaBalancing is the strategy used to spread the reads over the replicas
+type ReplicaBalancing int
+
+const (
+	RoundRobinReplicas ReplicaBalancing = iota
+	// pick the replica with the fewest connections in use
+	LeastConnectionsReplicas
+)
+
+type ReplicaConfig struct {
+	Host string
+	Port int
+}
+
+// ReplicaStatus is the state of a replica as of its last health check
+type ReplicaStatus struct {
+	Addr    string
+	Healthy bool
+	Lag     time.Duration // -1 when unknown
+}
+
+type readFromPrimaryKey struct{}
+
+// return a context whose select queries are sent to the primary, e.g. to
+// read rows right after writing them
+func ReadFromPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readFromPrimaryKey{}, true)
+}
+
+func readsFromPrimary(ctx context.Context) bool {
+	fromPrimary, _ := ctx.Value(readFromPrimaryKey{}).(bool)
+	return fromPrimary
+}
+
+type replica struct {
+	addr       string
+	client     *sql.DB
+	killClient *sql.DB
+	healthy    int32 // 1 when the replica serves reads
+	lag        int64 // replication lag of the last check, -1 when unknown
+}
+
+// replicaSet routes the reads over the healthy replicas
+type replicaSet struct {
+	replicas  []*replica
+	balancing ReplicaBalancing
+	maxLag    time.Duration
+	next      uint64
+	stop      chan struct{}
+}
+
+// return the replica set, the replicas are checked before returning and
+// then on every health check interval
+func newReplicaSet(replicas []*replica, cfg MySQLConfig) *replicaSet {
+	rs := &replicaSet{
+		replicas:  replicas,
+		balancing: cfg.ReplicaBalancing,
+		maxLag:    cfg.MaxReplicationLag,
+		stop:      make(chan struct{}),
+	}
+
+	interval := cfg.ReplicaHealthCheckInterval
+	if 0 == interval {
+		interval = defaultReplicaHealthCheckInterval
+	}
+
+	// replicas start healthy so only the failing ones get logged
+	for _, r := range replicas {
+		r.healthy = 1
+	}
+	rs.checkAll()
+	go rs.runHealthChecks(interval)
+
+	return rs
+}
+
+// return the replica to read from, nil when none is healthy
+func (rs *replicaSet) pick() *replica {
+	candidates := make([]*replica, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		if 1 == atomic.LoadInt32(&r.healthy) {
+			candidates = append(candidates, r)
+		}
+	}
+	if 0 == len(candidates) {
+		return nil
+	}
+
+	if LeastConnectionsReplicas == rs.balancing {
+		best, bestInUse := candidates[0], candidates[0].client.Stats().InUse
+		for _, r := range candidates[1:] {
+			if inUse := r.client.Stats().InUse; inUse < bestInUse {
+				best, bestInUse = r, inUse
+			}
+		}
+		return best
+	}
+
+	index := atomic.AddUint64(&rs.next, 1) - 1
+	return candidates[index%(uint64)(len(candidates))]
+}
+
+// check the replicas on the given interval until stopped
+func (rs *replicaSet) runHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+		}
+		rs.checkAll()
+	}
+}
+
+func (rs *replicaSet) checkAll() {
+	var wg sync.WaitGroup
+	for _, r := range rs.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			rs.check(r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// a replica is healthy when it answers and, if MaxReplicationLag is set,
+// when it does not lag further behind the primary
+func (rs *replicaSet) check(r *replica) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultReplicaHealthCheckTimeout)
+	defer cancel()
+
+	err := r.client.PingContext(ctx)
+	lag := time.Duration(-1)
+	if nil == err && rs.maxLag > 0 {
+		var lagErr error
+		if lag, lagErr = replicationLag(ctx, r.client); nil != lagErr {
+			lag, err = -1, lagErr
+		} else if lag > rs.maxLag {
+			err = fmt.Errorf("replication lag %v exceeds %v", lag, rs.maxLag)
+		}
+	}
+	atomic.StoreInt64(&r.lag, int64(lag))
+
+	healthy := int32(0)
+	if nil == err {
+		healthy = 1
+	}
+	if previous := atomic.SwapInt32(&r.healthy, healthy); previous != healthy {
+		if nil == err {
+			log.Println("MySQL replica", r.addr, "is healthy again.")
+		} else {
+			log.Println("MySQL replica", r.addr, "is ejected.", err.Error())
+		}
+	}
+}
+
+// return how far the replica lags behind its primary, 0 is returned when the
+// server is not a replica
+func replicationLag(ctx context.Context, client *sql.DB) (time.Duration, error) {
+	rows, err := client.QueryContext(ctx, "SHOW REPLICA STATUS")
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && errParse == mysqlErr.Number {
+		// servers older than 8.0.22
+		rows, err = client.QueryContext(ctx, "SHOW SLAVE STATUS")
+	}
+	if nil != err {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if nil != err {
+		return 0, err
+	}
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	targets := make([]any, len(columns))
+	for idx := range values {
+		targets[idx] = &values[idx]
+	}
+	if err := rows.Scan(targets...); nil != err {
+		return 0, err
+	}
+
+	for idx, column := range columns {
+		if "Seconds_Behind_Source" != column && "Seconds_Behind_Master" != column {
+			continue
+		}
+		if nil == values[idx] {
+			return 0, ErrReplicationStopped
+		}
+		seconds, err := strconv.ParseInt(string(values[idx]), 10, 64)
+		if nil != err {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return 0, nil
+}
+
+func (rs *replicaSet) close() {
+	close(rs.stop)
+	for _, r := range rs.replicas {
+		if nil != r.killClient {
+			r.killClient.Close()
+		}
+		if err := r.client.Close(); nil != err {
+			log.Println("Error while closing MySQL replica connection!!! ", err.Error())
+		}
+	}
+}
+
+// return the pool to run select queries on
+func (conn *MysqlConnector) readClient(ctx context.Context) *sql.DB {
+	if nil == conn.replicas || readsFromPrimary(ctx) {
+		return conn.client
+	}
+	if r := conn.replicas.pick(); nil != r {
+		return r.client
+	}
+	// every replica is ejected
+	return conn.client
+}
+
+// return the state of the replicas
+func (conn *MysqlConnector) ReplicaStatus() []ReplicaStatus {
+	if nil == conn.replicas {
+		return nil
+	}
+
+	status := make([]ReplicaStatus, 0, len(conn.replicas.replicas))
+	for _, r := range conn.replicas.replicas {
+		status = append(status, ReplicaStatus{
+			Addr:    r.addr,
+			Healthy: 1 == atomic.LoadInt32(&r.healthy),
+			Lag:     time.Duration(atomic.LoadInt64(&r.lag)),
+		})
+	}
+	return status
+}
@@ -0,0 +1,346 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sqlDateFormatLayout = "2006-01-02"
+)
+
+var (
+	ErrScalarColumns = errors.New("Scalar Destination Expects A Single Column")
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	timePtrType  = reflect.TypeOf((*time.Time)(nil))
+	nullTimeType = reflect.TypeOf(sql.NullTime{})
+	scannerType  = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+	// struct type -> column name to field index path
+	fieldMaps sync.Map
+)
+
+// Querier runs select queries, it is implemented by MysqlConnector and Tx
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	Location() *time.Location
+}
+
+// return all rows of the query mapped to T.
+// columns are mapped to the struct fields by their `db` tag, or by their
+// name ignoring the case when there is no tag, `db:"-"` skips a field.
+// fields of embedded structs are mapped as if they were declared in T.
+// DATETIME values are parsed in the connector Location.
+// when T is not a struct (e.g. int64, string, time.Time or a sql.Scanner)
+// the query must return a single column
+func QueryInto[T any](ctx context.Context, q Querier, query string, args ...any) ([]T, error) {
+	it, err := QueryIterator[T](ctx, q, query, args...)
+	if nil != err {
+		return nil, err
+	}
+
+	values := make([]T, 0)
+	for it.Next() {
+		values = append(values, it.Value())
+	}
+
+	return values, it.Err()
+}
+
+// return the first row of the query mapped to T, see QueryInto.
+// sql.ErrNoRows is returned when the query has no row
+func QueryOne[T any](ctx context.Context, q Querier, query string, args ...any) (T, error) {
+	var value T
+	it, err := QueryIterator[T](ctx, q, query, args...)
+	if nil != err {
+		return value, err
+	}
+	defer it.Close()
+
+	if !it.Next() {
+		if err := it.Err(); nil != err {
+			return value, err
+		}
+		return value, sql.ErrNoRows
+	}
+
+	return it.Value(), nil
+}
+
+// RowIterator streams the rows of a query mapped to T, see QueryInto.
+// the rows are closed once Next returns false, Close only needs to be called
+// when the iteration stops early
+//
+//	it, err := mysql.QueryIterator[Campaign](ctx, conn, query)
+//	for it.Next() {
+//		campaign := it.Value()
+//	}
+//	err = it.Err()
+type RowIterator[T any] struct {
+	rows    *sql.Rows
+	columns []string
+	fields  map[string][]int // nil when T is scalar
+	loc     *time.Location
+	value   T
+	err     error
+	closed  bool
+}
+
+// return an iterator over the rows of the query mapped to T
+func QueryIterator[T any](ctx context.Context, q Querier, query string, args ...any) (*RowIterator[T], error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if nil != err {
+		return nil, err
+	}
+
+	columns, err := rows.Columns()
+	if nil != err {
+		rows.Close()
+		return nil, err
+	}
+
+	it := &RowIterator[T]{
+		rows:    rows,
+		columns: columns,
+		loc:     q.Location(),
+	}
+
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if isScalarType(typ) {
+		if 1 != len(columns) {
+			rows.Close()
+			return nil, ErrScalarColumns
+		}
+	} else {
+		it.fields = structFields(typ)
+	}
+
+	return it, nil
+}
+
+// move to the next row, false is returned at the end of the rows or on error
+func (it *RowIterator[T]) Next() bool {
+	if it.closed {
+		return false
+	}
+
+	if !it.rows.Next() {
+		it.err = it.rows.Err()
+		it.Close()
+		return false
+	}
+
+	var value T
+	if err := it.scan(reflect.ValueOf(&value).Elem()); nil != err {
+		it.err = err
+		it.Close()
+		return false
+	}
+	it.value = value
+
+	return true
+}
+
+// return the current row
+func (it *RowIterator[T]) Value() T {
+	return it.value
+}
+
+// return the error which stopped the iteration, if any
+func (it *RowIterator[T]) Err() error {
+	return it.err
+}
+
+func (it *RowIterator[T]) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	return it.rows.Close()
+}
+
+func (it *RowIterator[T]) scan(dest reflect.Value) error {
+	if nil == it.fields {
+		return it.rows.Scan(scanTarget(dest, it.loc))
+	}
+
+	targets := make([]any, len(it.columns))
+	for idx, column := range it.columns {
+		path, ok := it.fields[strings.ToLower(column)]
+		if !ok {
+			// unmapped columns are discarded
+			targets[idx] = new(sql.RawBytes)
+			continue
+		}
+		targets[idx] = scanTarget(fieldByIndex(dest, path), it.loc)
+	}
+
+	return it.rows.Scan(targets...)
+}
+
+// return true if values of typ are scanned as a whole instead of by field
+func isScalarType(typ reflect.Type) bool {
+	if reflect.Struct != typ.Kind() || timeType == typ {
+		return true
+	}
+	return reflect.PtrTo(typ).Implements(scannerType)
+}
+
+// return the column to field index path mapping of the struct type
+func structFields(typ reflect.Type) map[string][]int {
+	if fields, ok := fieldMaps.Load(typ); ok {
+		return fields.(map[string][]int)
+	}
+
+	fields := make(map[string][]int)
+	collectFields(typ, nil, fields)
+	fieldMaps.Store(typ, fields)
+
+	return fields
+}
+
+// add the fields of typ to fields, the fields of embedded structs are added
+// after the direct fields so the shallowest field wins like in Go
+func collectFields(typ reflect.Type, index []int, fields map[string][]int) {
+	type embeddedStruct struct {
+		typ   reflect.Type
+		index []int
+	}
+	embedded := make([]embeddedStruct, 0)
+
+	for idx := 0; idx < typ.NumField(); idx++ {
+		field := typ.Field(idx)
+		tag := field.Tag.Get("db")
+		if "-" == tag {
+			continue
+		}
+
+		path := append(append(make([]int, 0, len(index)+1), index...), idx)
+
+		if field.Anonymous && "" == tag {
+			fieldType := field.Type
+			if reflect.Ptr == fieldType.Kind() {
+				fieldType = fieldType.Elem()
+			}
+			// unexported embedded pointers cannot be allocated
+			if !isScalarType(fieldType) && (field.IsExported() || reflect.Ptr != field.Type.Kind()) {
+				embedded = append(embedded, embeddedStruct{typ: fieldType, index: path})
+				continue
+			}
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		name := tag
+		if "" == name {
+			name = field.Name
+		}
+		name = strings.ToLower(name)
+		if _, ok := fields[name]; !ok {
+			fields[name] = path
+		}
+	}
+
+	for _, e := range embedded {
+		collectFields(e.typ, e.index, fields)
+	}
+}
+
+// return the field at the index path, allocating nil embedded pointers
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for _, idx := range index {
+		if reflect.Ptr == v.Kind() {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(idx)
+	}
+	return v
+}
+
+// return the Scan destination of the field
+func scanTarget(field reflect.Value, loc *time.Location) any {
+	switch field.Type() {
+	case timeType, timePtrType, nullTimeType:
+		return &timeScanner{field: field, loc: loc}
+	}
+	return field.Addr().Interface()
+}
+
+// timeScanner scans DATE, DATETIME and TIMESTAMP values, which the driver
+// returns as text unless parseTime is enabled, into time fields
+type timeScanner struct {
+	field reflect.Value
+	loc   *time.Location
+}
+
+func (ts *timeScanner) Scan(src any) error {
+	var value time.Time
+	valid := true
+
+	switch v := src.(type) {
+	case nil:
+		valid = false
+	case time.Time:
+		value = v.In(ts.loc)
+	case []byte:
+		return ts.parse(string(v))
+	case string:
+		return ts.parse(v)
+	default:
+		return fmt.Errorf("mysql: cannot scan %T into %s", src, ts.field.Type())
+	}
+
+	ts.set(value, valid)
+	return nil
+}
+
+func (ts *timeScanner) parse(text string) error {
+	// zero dates are returned by the server when NO_ZERO_DATE is not set
+	if strings.HasPrefix(text, "0000-00-00") {
+		ts.set(time.Time{}, false)
+		return nil
+	}
+
+	layout := SQLTimeFormatLayout
+	if len(sqlDateFormatLayout) == len(text) {
+		layout = sqlDateFormatLayout
+	}
+
+	// fractional seconds are accepted even though the layout has none
+	value, err := time.ParseInLocation(layout, text, ts.loc)
+	if nil != err {
+		return err
+	}
+
+	ts.set(value, true)
+	return nil
+}
+
+func (ts *timeScanner) set(value time.Time, valid bool) {
+	switch ts.field.Type() {
+	case timeType:
+		ts.field.Set(reflect.ValueOf(value))
+	case timePtrType:
+		if valid {
+			ts.field.Set(reflect.ValueOf(&value))
+		} else {
+			ts.field.Set(reflect.Zero(timePtrType))
+		}
+	case nullTimeType:
+		ts.field.Set(reflect.ValueOf(sql.NullTime{Time: value, Valid: valid}))
+	}
+}
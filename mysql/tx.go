@@ -0,0 +1,180 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	defaultTxMaxRetries   = 3
+	defaultTxRetryBackoff = 50 * time.Millisecond
+
+	errLockWaitTimeout = 1205 // ER_LOCK_WAIT_TIMEOUT
+	errLockDeadlock    = 1213 // ER_LOCK_DEADLOCK
+)
+
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// retries of the whole transaction when it fails on a deadlock or a lock
+	// wait timeout, 0 means 3 and a negative value disables the retries
+	MaxRetries int
+	// delay before the first retry, doubled on every retry, 0 means 50 ms
+	RetryBackoff time.Duration
+}
+
+// Tx is the transaction given to the WithTx callback
+type Tx struct {
+	tx               *sql.Tx
+	location         *time.Location
+	maxAllowedPacket int
+	savepoints       int
+}
+
+// run fn in a transaction which is committed when fn returns nil and rolled
+// back when it returns an error or panics.
+// the transaction is retried from the start on deadlock and lock wait
+// timeout, so fn must not have side effects outside of the transaction.
+// when ctx has no deadline, the configured QueryTimeout bounds every attempt
+// of the whole transaction and the statement running when it expires is
+// killed as for ExecContext. opts may be nil
+func (conn *MysqlConnector) WithTx(ctx context.Context, opts *TxOptions, fn func(tx *Tx) error) error {
+	if nil == opts {
+		opts = &TxOptions{}
+	}
+
+	maxRetries := opts.MaxRetries
+	if 0 == maxRetries {
+		maxRetries = defaultTxMaxRetries
+	}
+	backoff := opts.RetryBackoff
+	if 0 == backoff {
+		backoff = defaultTxRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := conn.runTx(ctx, opts, fn)
+		if nil == err || !IsRetryableTxError(err) || attempt >= maxRetries {
+			return err
+		}
+
+		// jitter desynchronizes the transactions which deadlocked together
+		delay := backoff << attempt
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (conn *MysqlConnector) runTx(ctx context.Context, opts *TxOptions, fn func(tx *Tx) error) error {
+	// cancelled once the transaction is committed or rolled back
+	ctx, cancel := conn.queryContext(ctx)
+	defer cancel()
+	if nil == ctx.Done() {
+		return conn.runTxOn(ctx, conn.client.BeginTx, opts, fn)
+	}
+
+	c, err := conn.runKillable(ctx, conn.client, func(c *sql.Conn) error {
+		return conn.runTxOn(ctx, c.BeginTx, opts, fn)
+	})
+	if nil != err {
+		return err
+	}
+	c.Close()
+
+	return nil
+}
+
+func (conn *MysqlConnector) runTxOn(
+	ctx context.Context,
+	beginTx func(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error),
+	opts *TxOptions,
+	fn func(tx *Tx) error) (err error) {
+	sqlTx, err := beginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if nil != err {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); nil != p {
+			sqlTx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = fn(&Tx{tx: sqlTx, location: conn.location, maxAllowedPacket: conn.maxAllowedPacket}); nil != err {
+		sqlTx.Rollback()
+		return err
+	}
+
+	return sqlTx.Commit()
+}
+
+// return true if err is a deadlock or a lock wait timeout, after which the
+// transaction can be run again
+func IsRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return errLockDeadlock == mysqlErr.Number || errLockWaitTimeout == mysqlErr.Number
+	}
+	return false
+}
+
+// execute the select query in the transaction
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return tx.tx.QueryContext(ctx, query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return tx.tx.QueryRowContext(ctx, query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.tx.ExecContext(ctx, query, args...)
+}
+
+// return the time zone of the DATETIME and TIMESTAMP values
+func (tx *Tx) Location() *time.Location {
+	return tx.location
+}
+
+// run fn within a savepoint, its changes are rolled back when it returns an
+// error while the rest of the transaction goes on. savepoints can be nested.
+// a deadlock rolls back the whole transaction, its error is returned as is
+// so WithTx retries the transaction
+func (tx *Tx) Savepoint(ctx context.Context, fn func(tx *Tx) error) error {
+	tx.savepoints++
+	name := fmt.Sprintf("sp_%d", tx.savepoints)
+
+	if _, err := tx.tx.ExecContext(ctx, "SAVEPOINT "+name); nil != err {
+		return err
+	}
+
+	if err := fn(tx); nil != err {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && errLockDeadlock == mysqlErr.Number {
+			// the server already rolled back the transaction and its savepoints
+			return err
+		}
+		if _, rbErr := tx.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); nil != rbErr {
+			// e.g. the savepoint is gone after a lock wait timeout with
+			// innodb_rollback_on_timeout, err is what WithTx must see
+			return fmt.Errorf("%w (rollback to savepoint failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	_, err := tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
@@ -0,0 +1,316 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchInterval   = 10 * time.Second
+	defaultWatchMaxBackoff = 5 * time.Minute
+)
+
+var (
+	ErrNoTables = errors.New("No Table To Watch")
+)
+
+// ChangeFallback is how changes are detected on the tables whose
+// INFORMATION_SCHEMA.PARTITIONS.UPDATE_TIME is NULL
+type ChangeFallback int
+
+const (
+	// CHECKSUM TABLE, it reads the whole table
+	ChecksumFallback ChangeFallback = iota
+	// SELECT COUNT(*), cheaper but misses the updates keeping the row count
+	RowCountFallback
+	// the tables without UPDATE_TIME are never reported as changed
+	NoFallback
+)
+
+type TableWatcherConfig struct {
+	Database string
+	Tables   []string
+	// polling interval, 10 seconds by default
+	Interval time.Duration
+	// the interval doubles on every failed poll up to MaxBackoff,
+	// 5 minutes by default
+	MaxBackoff time.Duration
+	Fallback   ChangeFallback
+}
+
+// TableWatcher polls the tables and calls the registered callbacks with the
+// names of the tables changed since the previous poll. it is the per table
+// counterpart of CheckTableUpdatedSince, which needs the select privilege on
+// INFORMATION_SCHEMA.PARTITIONS as well
+//
+//	watcher, err := conn.NewTableWatcher(mysql.TableWatcherConfig{Database: "ads", Tables: tables})
+//	if nil != err {
+//		return err
+//	}
+//	watcher.OnChange(func(changed []string) { reload(changed) })
+//	watcher.Start()
+//	defer watcher.Stop()
+type TableWatcher struct {
+	conn *MysqlConnector
+	cfg  TableWatcherConfig
+
+	mu         sync.Mutex
+	callbacks  []func(changed []string)
+	signatures map[string]string    // table -> last seen update time or fingerprint
+	lastSeen   map[string]time.Time // table -> last seen UPDATE_TIME
+
+	started bool // guarded by mu as well
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type tableUpdate struct {
+	Table      string       `db:"table_name"`
+	UpdateTime sql.NullTime `db:"update_time"`
+}
+
+type tableFingerprint struct {
+	Table    string         `db:"Table"`
+	Checksum sql.NullString `db:"Checksum"`
+}
+
+// return a watcher of the tables, polling starts with Start
+func (conn *MysqlConnector) NewTableWatcher(cfg TableWatcherConfig) (*TableWatcher, error) {
+	if 0 == len(cfg.Tables) {
+		return nil, ErrNoTables
+	}
+	if 0 == cfg.Interval {
+		cfg.Interval = defaultWatchInterval
+	}
+	if 0 == cfg.MaxBackoff {
+		cfg.MaxBackoff = defaultWatchMaxBackoff
+	}
+	if cfg.MaxBackoff < cfg.Interval {
+		cfg.MaxBackoff = cfg.Interval
+	}
+
+	return &TableWatcher{
+		conn:       conn,
+		cfg:        cfg,
+		callbacks:  make([]func(changed []string), 0),
+		signatures: make(map[string]string),
+		lastSeen:   make(map[string]time.Time),
+	}, nil
+}
+
+// register a callback of the changes, the callbacks are called one after
+// the other from the polling goroutine
+func (w *TableWatcher) OnChange(callback func(changed []string)) {
+	w.mu.Lock()
+	w.callbacks = append(w.callbacks, callback)
+	w.mu.Unlock()
+}
+
+// start polling in the background, the first poll records the current state
+// of the tables without calling the callbacks. it does nothing when the
+// watcher is already started, a stopped watcher cannot be started again
+func (w *TableWatcher) Start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.started || w.stopped {
+		return
+	}
+	w.started = true
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.run()
+}
+
+// stop polling and wait for the running poll, if any, to complete. it does
+// nothing when the watcher is not started or is already stopped
+func (w *TableWatcher) Stop() {
+	w.mu.Lock()
+	if !w.started || w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	w.mu.Unlock()
+
+	// the running poll takes mu
+	close(w.stop)
+	<-w.done
+}
+
+// return the last UPDATE_TIME seen per table, the tables without one are
+// not listed
+func (w *TableWatcher) LastSeen() map[string]time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lastSeen := make(map[string]time.Time, len(w.lastSeen))
+	for table, updateTime := range w.lastSeen {
+		lastSeen[table] = updateTime
+	}
+	return lastSeen
+}
+
+func (w *TableWatcher) run() {
+	defer close(w.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	delay := w.cfg.Interval
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+		}
+
+		if _, err := w.Poll(ctx); nil != err {
+			if nil != ctx.Err() {
+				return
+			}
+			log.Println("Failed to poll MySQL tables update.", err.Error())
+			if delay *= 2; delay > w.cfg.MaxBackoff {
+				delay = w.cfg.MaxBackoff
+			}
+		} else {
+			delay = w.cfg.Interval
+		}
+		timer.Reset(delay)
+	}
+}
+
+// poll the tables once, call the callbacks and return the changed tables.
+// the first poll only records the state of the tables
+func (w *TableWatcher) Poll(ctx context.Context) ([]string, error) {
+	signatures, lastSeen, err := w.readSignatures(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	changed := make([]string, 0)
+	for table, signature := range signatures {
+		if previous, ok := w.signatures[table]; ok && previous != signature {
+			changed = append(changed, table)
+		}
+	}
+	w.signatures = signatures
+	w.lastSeen = lastSeen
+	callbacks := append([]func(changed []string){}, w.callbacks...)
+	w.mu.Unlock()
+
+	if 0 == len(changed) {
+		return changed, nil
+	}
+
+	sort.Strings(changed)
+	for _, callback := range callbacks {
+		callback(changed)
+	}
+	return changed, nil
+}
+
+// return the signature of every table, its UPDATE_TIME or its fingerprint
+// when the engine does not maintain UPDATE_TIME, and the UPDATE_TIME of the
+// tables which have one
+func (w *TableWatcher) readSignatures(ctx context.Context) (map[string]string, map[string]time.Time, error) {
+	// table names are case insensitive on some platforms
+	names := make(map[string]string, len(w.cfg.Tables))
+	for _, table := range w.cfg.Tables {
+		names[strings.ToLower(table)] = table
+	}
+
+	buff, values := partitionsQuery("TABLE_NAME AS table_name, MAX(UPDATE_TIME) AS update_time", w.cfg.Database, w.cfg.Tables)
+	buff.WriteString(" GROUP BY TABLE_NAME")
+
+	updates, err := QueryInto[tableUpdate](ctx, w.conn, buff.String(), values...)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	signatures := make(map[string]string, len(w.cfg.Tables))
+	lastSeen := make(map[string]time.Time, len(w.cfg.Tables))
+	for _, update := range updates {
+		table, ok := names[strings.ToLower(update.Table)]
+		if !ok || !update.UpdateTime.Valid {
+			continue
+		}
+		signatures[table] = "updated:" + update.UpdateTime.Time.Format(time.RFC3339Nano)
+		lastSeen[table] = update.UpdateTime.Time
+	}
+
+	missing := make([]string, 0)
+	for _, table := range w.cfg.Tables {
+		if _, ok := signatures[table]; !ok {
+			missing = append(missing, table)
+		}
+	}
+	if 0 == len(missing) || NoFallback == w.cfg.Fallback {
+		return signatures, lastSeen, nil
+	}
+
+	fingerprints, err := w.fingerprints(ctx, missing)
+	if nil != err {
+		return nil, nil, err
+	}
+	for table, fingerprint := range fingerprints {
+		signatures[table] = "fingerprint:" + fingerprint
+	}
+
+	return signatures, lastSeen, nil
+}
+
+// return the checksum or the row count of the tables
+func (w *TableWatcher) fingerprints(ctx context.Context, tables []string) (map[string]string, error) {
+	fingerprints := make(map[string]string, len(tables))
+
+	if RowCountFallback == w.cfg.Fallback {
+		for _, table := range tables {
+			count, err := QueryOne[int64](ctx, w.conn, "SELECT COUNT(*) FROM "+quoteIdentifier(w.cfg.Database+"."+table))
+			if nil != err {
+				return nil, err
+			}
+			fingerprints[table] = fmt.Sprint(count)
+		}
+		return fingerprints, nil
+	}
+
+	quoted := make([]string, 0, len(tables))
+	names := make(map[string]string, len(tables))
+	for _, table := range tables {
+		quoted = append(quoted, quoteIdentifier(w.cfg.Database+"."+table))
+		names[strings.ToLower(w.cfg.Database+"."+table)] = table
+	}
+
+	checksums, err := QueryInto[tableFingerprint](ctx, w.conn, "CHECKSUM TABLE "+strings.Join(quoted, ", "))
+	if nil != err {
+		return nil, err
+	}
+	for _, checksum := range checksums {
+		if table, ok := names[strings.ToLower(checksum.Table)]; ok {
+			// NULL when the table does not exist
+			fingerprints[table] = checksum.Checksum.String
+		}
+	}
+
+	return fingerprints, nil
+}